@@ -0,0 +1,224 @@
+package concurrency
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// AdaptiveLimitAlgorithm decides how an adaptive limit changes based on the
+// latency and errors of the processing function calls.
+type AdaptiveLimitAlgorithm int
+
+const (
+	// Additive increase, multiplicative decrease. While the limit is mostly in use,
+	// it goes up by one for every round of successful calls (a limit's worth of them),
+	// and it's multiplied by the BackoffRatio for every call that failed or took
+	// longer than the LatencyThreshold.
+	AdaptiveLimitAIMD AdaptiveLimitAlgorithm = iota
+	// The limit follows the ratio between the base latency (the lowest recent latency)
+	// and the latency of each call, like TCP Vegas. It goes down when calls get slower
+	// than the base latency, and up (by about the square root of the limit) while they
+	// aren't. It's also multiplied by the BackoffRatio for every call that failed.
+	AdaptiveLimitGradient
+)
+
+func (a AdaptiveLimitAlgorithm) String() string {
+	switch a {
+	case AdaptiveLimitAIMD:
+		return "AIMD"
+	case AdaptiveLimitGradient:
+		return "Gradient"
+	default:
+		return "Unknown"
+	}
+}
+
+// AdaptiveLimit is a limit on the number of processing function calls of an executor
+// that can be in flight at once, which adapts to the latency and errors of the calls.
+type AdaptiveLimit struct {
+	// REQUIRED. The maximum limit. Adaptive limiting is disabled if this is 0.
+	MaxLimit int
+	// OPTIONAL. The minimum limit. Defaults to 1.
+	MinLimit int
+	// OPTIONAL. The limit to start with. Defaults to MinLimit.
+	InitialLimit int
+	// OPTIONAL. The algorithm to use. Defaults to AdaptiveLimitAIMD.
+	Algorithm AdaptiveLimitAlgorithm
+	// OPTIONAL. For AdaptiveLimitAIMD, calls that take longer than this are treated
+	// like failed calls. If 0, only failed calls reduce the limit.
+	LatencyThreshold time.Duration
+	// OPTIONAL. The ratio that the limit is multiplied by when it's reduced. Defaults
+	// to 0.9.
+	BackoffRatio float64
+	// OPTIONAL. For AdaptiveLimitGradient, how many times slower than the base latency
+	// the calls can get before the limit is reduced. Defaults to 1.5.
+	Tolerance float64
+}
+
+func (al AdaptiveLimit) enabled() bool {
+	return al.MaxLimit > 0
+}
+
+const (
+	// How slowly (in calls) the base latency of the gradient algorithm rises towards
+	// the latency of calls that are slower than it, so that it can follow a lasting
+	// change in the latency.
+	adaptiveLimitBaseWindow = 1000
+	// How much of a change the gradient algorithm applies to the limit at once
+	adaptiveLimitSmoothing = 0.2
+)
+
+// An adaptive limiter, where routines wait in order for a slot to make a call. The
+// limit is updated after every call.
+type adaptiveLimiter struct {
+	settings AdaptiveLimit
+	minLimit float64
+	maxLimit float64
+
+	lock     sync.Mutex
+	limit    float64
+	inFlight int
+	// The routines that are waiting for a slot, in order. A slot is
+	// handed to a routine by closing its channel.
+	waiters []chan struct{}
+	// The base latency, for the gradient algorithm
+	baseLatency float64
+}
+
+func newAdaptiveLimiter(settings AdaptiveLimit) *adaptiveLimiter {
+	if !settings.enabled() {
+		return nil
+	}
+	minLimit := settings.MinLimit
+	if minLimit < 1 {
+		minLimit = 1
+	}
+	if minLimit > settings.MaxLimit {
+		panic("input.AdaptiveLimit.MinLimit cannot be greater than input.AdaptiveLimit.MaxLimit")
+	}
+	initial := zeroDefault(settings.InitialLimit, minLimit)
+	if settings.BackoffRatio <= 0 || settings.BackoffRatio >= 1 {
+		settings.BackoffRatio = 0.9
+	}
+	if settings.Tolerance < 1 {
+		settings.Tolerance = 1.5
+	}
+	al := &adaptiveLimiter{
+		settings: settings,
+		minLimit: float64(minLimit),
+		maxLimit: float64(settings.MaxLimit),
+	}
+	al.limit = al.clamp(float64(initial))
+	return al
+}
+
+func (al *adaptiveLimiter) clamp(limit float64) float64 {
+	return math.Max(al.minLimit, math.Min(al.maxLimit, limit))
+}
+
+// getLimit returns the current number of calls that can be in flight at once.
+func (al *adaptiveLimiter) getLimit() int {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	return int(al.limit)
+}
+
+// grant hands slots to waiting routines, for as long as the limit allows. Must
+// be called with the lock held.
+func (al *adaptiveLimiter) grant() {
+	for len(al.waiters) > 0 && al.inFlight < int(al.limit) {
+		close(al.waiters[0])
+		al.waiters = al.waiters[1:]
+		al.inFlight++
+	}
+}
+
+// acquire waits for a slot to make a call. The onWait function is called before
+// waiting, if no slot is available right away. Returns false if the context is
+// done first.
+func (al *adaptiveLimiter) acquire(ctx context.Context, onWait func()) bool {
+	al.lock.Lock()
+	if len(al.waiters) == 0 && al.inFlight < int(al.limit) {
+		al.inFlight++
+		al.lock.Unlock()
+		return true
+	}
+	ready := make(chan struct{})
+	al.waiters = append(al.waiters, ready)
+	al.lock.Unlock()
+
+	onWait()
+	select {
+	case <-ready:
+		return true
+	case <-ctx.Done():
+		al.lock.Lock()
+		defer al.lock.Unlock()
+		for i, waiter := range al.waiters {
+			if waiter == ready {
+				al.waiters = append(al.waiters[:i], al.waiters[i+1:]...)
+				return false
+			}
+		}
+		// The slot was handed over at the same time, so pass it on
+		al.inFlight--
+		al.grant()
+		return false
+	}
+}
+
+// release gives back the slot of a finished call, and updates the limit based
+// on how long the call took and whether it failed. Calls that shouldn't affect
+// the limit (e.g. because the context was cancelled) aren't sampled.
+func (al *adaptiveLimiter) release(latency time.Duration, failed bool, sample bool) {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if sample {
+		al.update(latency, failed)
+	}
+	al.inFlight--
+	al.grant()
+}
+
+// update changes the limit based on a call. Must be called with the lock held.
+func (al *adaptiveLimiter) update(latency time.Duration, failed bool) {
+	// Only raise the limit if it's actually being used, so it doesn't
+	// grow without bound while the executor is mostly idle.
+	inUse := float64(al.inFlight)*2 >= al.limit
+	switch al.settings.Algorithm {
+	case AdaptiveLimitGradient:
+		if failed {
+			al.limit = al.clamp(al.limit * al.settings.BackoffRatio)
+			return
+		}
+		sample := float64(latency)
+		if sample <= 0 {
+			sample = 1
+		}
+		if al.baseLatency == 0 || sample < al.baseLatency {
+			al.baseLatency = sample
+		} else {
+			al.baseLatency += (sample - al.baseLatency) / adaptiveLimitBaseWindow
+		}
+		gradient := math.Max(0.5, math.Min(1, al.settings.Tolerance*al.baseLatency/sample))
+		if gradient == 1 && !inUse {
+			return
+		}
+		newLimit := al.limit * gradient
+		if gradient == 1 {
+			// The calls aren't slower than usual, so try a higher limit
+			newLimit += math.Sqrt(al.limit)
+		}
+		al.limit = al.clamp(al.limit*(1-adaptiveLimitSmoothing) + newLimit*adaptiveLimitSmoothing)
+	default:
+		if failed || (al.settings.LatencyThreshold > 0 && latency > al.settings.LatencyThreshold) {
+			al.limit = al.clamp(al.limit * al.settings.BackoffRatio)
+			return
+		}
+		if inUse {
+			al.limit = al.clamp(al.limit + 1/al.limit)
+		}
+	}
+}
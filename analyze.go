@@ -0,0 +1,181 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+const (
+	// The minimum score of a stage to be reported as the bottleneck
+	analyzeBottleneckScore = 0.25
+	// The fraction of time a stage's routines have to spend waiting for inputs to be starved
+	analyzeStarvedRatio = 0.5
+	// How much spare capacity to leave when suggesting fewer routines for a starved stage
+	analyzeStarvedHeadroom = 1.25
+)
+
+// The error that Analyze fails with when the window isn't greater than 0.
+var ErrAnalyzeWindow = errors.New("the analysis window must be greater than 0")
+
+// StageAnalysis is how an executor in a chain behaved during the analysis window.
+type StageAnalysis struct {
+	// The name of the executor
+	ExecutorName string
+	// The position of the executor in the chain, starting at 0
+	Stage int
+	// The number of routines that were running at the end of the window
+	Concurrency int
+	// The number of inputs per second that the processing function finished
+	Throughput float64
+	// How the time of the routines was spent during the window
+	Utilization *Utilization
+	// How strongly the stage looks like the bottleneck of the chain, from 0 to 1. It's
+	// higher when the stage is busy (processing or waiting for its limits) while the
+	// stage before it waits to output and the stage after it waits for inputs.
+	Score float64
+	// Whether the stage's routines spent most of the window waiting for inputs
+	Starved bool
+	// The suggested number of routines. Equal to Concurrency if no change is suggested.
+	SuggestedConcurrency int
+	// Why the change (or lack of a change) is suggested
+	Reason string
+}
+
+// BottleneckReport is the result of analyzing a chain over a window of time.
+type BottleneckReport struct {
+	// How long the chain was sampled for
+	Window time.Duration
+	// The stage that limits the throughput of the chain, or nil if no stage was busy
+	// enough to be the bottleneck
+	Bottleneck *StageAnalysis
+	// The stages that spent most of the window waiting for inputs, in order of the chain
+	Starved []*StageAnalysis
+	// All stages, ranked by their score, highest first
+	Stages []*StageAnalysis
+}
+
+// A sample of a tracker at a point in time
+type analyzeSample struct {
+	timeInStatus []time.Duration
+	numProcessed uint64
+}
+
+func sampleTracker(tracker *RoutineStatusTracker) analyzeSample {
+	return analyzeSample{
+		timeInStatus: tracker.getTimeInStatus(),
+		numProcessed: tracker.GetNumProcessed(),
+	}
+}
+
+// Analyze samples the executors in the chain, up to and including this one, over the
+// given window, and works out which stage limits the throughput of the chain, which
+// stages are starved of inputs, and how their numbers of routines could be changed.
+// Returns an error if the window isn't greater than 0, or if the context is done before
+// the window has passed.
+func (eo *ExecutorOutput[OutputChanType]) Analyze(ctx context.Context, window time.Duration) (*BottleneckReport, stackerr.Error) {
+	if window <= 0 {
+		return nil, stackerr.Wrap(ErrAnalyzeWindow)
+	}
+	trackers := eo.routineStatusTrackersSlice
+	start := make([]analyzeSample, len(trackers))
+	for i, tracker := range trackers {
+		start[i] = sampleTracker(tracker)
+	}
+	startTime := time.Now()
+
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, contextError(ctx)
+	case <-timer.C:
+	}
+
+	elapsed := time.Since(startTime)
+	report := &BottleneckReport{
+		Window: elapsed,
+		Stages: make([]*StageAnalysis, len(trackers)),
+	}
+	for i, tracker := range trackers {
+		end := sampleTracker(tracker)
+		timeInStatus := make([]time.Duration, numRoutineStatuses)
+		for status := range timeInStatus {
+			timeInStatus[status] = end.timeInStatus[status] - start[i].timeInStatus[status]
+		}
+		report.Stages[i] = &StageAnalysis{
+			ExecutorName: tracker.GetExecutorName(),
+			Stage:        i,
+			Concurrency:  int(tracker.GetNumRoutinesRunning()),
+			Throughput:   float64(end.numProcessed-start[i].numProcessed) / elapsed.Seconds(),
+			Utilization:  newUtilization(timeInStatus),
+		}
+	}
+
+	for i, stage := range report.Stages {
+		busy := stage.Utilization.Processing + stage.Utilization.RateLimited + stage.Utilization.AwaitingLimiter
+		// The stages around a bottleneck are held up by it: the one before it waits
+		// to output, and the one after it waits for inputs.
+		var pressure float64
+		var signals int
+		if i > 0 {
+			pressure += report.Stages[i-1].Utilization.AwaitingOutput
+			signals++
+		}
+		if i < len(report.Stages)-1 {
+			pressure += report.Stages[i+1].Utilization.AwaitingInput
+			signals++
+		}
+		if signals > 0 {
+			pressure /= float64(signals)
+		}
+		stage.Score = busy * (1 + pressure) / 2
+		stage.Starved = stage.Utilization.RoutineTime > 0 && stage.Utilization.AwaitingInput >= analyzeStarvedRatio
+		stage.SuggestedConcurrency = stage.Concurrency
+		switch {
+		case stage.Concurrency == 0:
+			stage.Reason = "not running"
+		case stage.Utilization.RoutineTime <= 0:
+			stage.Reason = "no activity during the window"
+		case stage.Starved:
+			// Keep enough routines for the work there was, with some headroom
+			needed := int(math.Ceil(float64(stage.Concurrency) * (1 - stage.Utilization.AwaitingInput) * analyzeStarvedHeadroom))
+			if needed < 1 {
+				needed = 1
+			}
+			if needed < stage.Concurrency {
+				stage.SuggestedConcurrency = needed
+				stage.Reason = "starved of inputs, so fewer routines would do"
+			} else {
+				stage.Reason = "starved of inputs"
+			}
+		case stage.Utilization.AwaitingOutput >= analyzeStarvedRatio:
+			stage.Reason = "held up by the stage after it"
+		case stage.Utilization.RateLimited+stage.Utilization.AwaitingLimiter > stage.Utilization.Processing:
+			stage.Reason = "held up by its rate limit or limiter, so more routines wouldn't help"
+		case stage.Score >= analyzeBottleneckScore:
+			stage.SuggestedConcurrency = int(math.Ceil(float64(stage.Concurrency) * (1 + pressure)))
+			if stage.SuggestedConcurrency == stage.Concurrency {
+				stage.SuggestedConcurrency++
+			}
+			stage.Reason = "busy processing, so more routines would raise the throughput"
+		default:
+			stage.Reason = "keeping up"
+		}
+		if stage.Starved {
+			report.Starved = append(report.Starved, stage)
+		}
+	}
+
+	sort.SliceStable(report.Stages, func(i, j int) bool {
+		return report.Stages[i].Score > report.Stages[j].Score
+	})
+	if len(report.Stages) > 0 && report.Stages[0].Score >= analyzeBottleneckScore {
+		report.Bottleneck = report.Stages[0]
+	}
+	return report, nil
+}
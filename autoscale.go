@@ -0,0 +1,133 @@
+package concurrency
+
+import (
+	"context"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+// AutoScale changes the number of routines of an executor based on its load. The
+// executor grows when its routines are busy processing and the backlog of inputs is
+// rising or larger than the number of routines, and shrinks when routines are waiting
+// for inputs and there's no backlog.
+type AutoScale struct {
+	// REQUIRED. The maximum number of routines. Autoscaling is disabled if this is 0.
+	MaxConcurrency int
+	// OPTIONAL. The minimum number of routines. Defaults to 1.
+	MinConcurrency int
+	// OPTIONAL. How often to evaluate the load of the executor. Defaults to the
+	// DefaultAutoScaleInterval value.
+	Interval time.Duration
+	// OPTIONAL. The minimum amount of time between changes of the number of routines.
+	// Defaults to the DefaultAutoScaleCooldown value.
+	Cooldown time.Duration
+	// OPTIONAL. A function to call after the number of routines has been changed. If it
+	// returns an error, the executor fails with that error.
+	Callback func(input *AutoScaleCallbackInput) stackerr.Error
+}
+
+func (as AutoScale) enabled() bool {
+	return as.MaxConcurrency > 0
+}
+
+func (as AutoScale) minConcurrency() int {
+	if as.MinConcurrency < 1 {
+		return 1
+	}
+	return as.MinConcurrency
+}
+
+// clamp limits a number of routines to the bounds of the autoscaling.
+func (as AutoScale) clamp(concurrency int) int {
+	if concurrency > as.MaxConcurrency {
+		concurrency = as.MaxConcurrency
+	}
+	if minimum := as.minConcurrency(); concurrency < minimum {
+		concurrency = minimum
+	}
+	return concurrency
+}
+
+// decide returns the number of routines the executor should have, based on
+// its current load.
+func (as AutoScale) decide(current int, backlog int, previousBacklog int, awaitingInput int, processing int) int {
+	next := current
+	if backlog > 0 && (backlog >= previousBacklog || backlog > current) && awaitingInput == 0 && 2*processing >= current {
+		// The backlog isn't going down quickly and the routines are busy processing
+		// (instead of waiting for something else that more routines wouldn't help
+		// with), so add routines, up to twice as many.
+		grow := backlog
+		if grow > current {
+			grow = current
+		}
+		next = current + grow
+	} else if backlog == 0 && awaitingInput > 0 {
+		// Routines are sitting idle, so retire half of them
+		shrink := awaitingInput / 2
+		if shrink < 1 {
+			shrink = 1
+		}
+		next = current - shrink
+	}
+	return as.clamp(next)
+}
+
+// runAutoScaler evaluates the load of the executor at every interval and changes
+// the number of routines accordingly, until the executor has finished.
+func runAutoScaler(
+	ctx context.Context,
+	finished <-chan struct{},
+	settings AutoScale,
+	scaler *routineScaler,
+	tracker *RoutineStatusTracker,
+	baseExecutorCallbackInput *BaseExecutorCallbackInput,
+	fail func(err error),
+) {
+	ticker := time.NewTicker(zeroDefault(settings.Interval, DefaultAutoScaleInterval))
+	defer ticker.Stop()
+	cooldown := zeroDefault(settings.Cooldown, DefaultAutoScaleCooldown)
+
+	var lastChange time.Time
+	previousBacklog := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-finished:
+			return
+		case <-ticker.C:
+		}
+
+		// The backlog is everything that's waiting to be taken by a routine
+		backlog := tracker.GetInputChanLength()
+		for _, depth := range tracker.GetFairQueueDepths() {
+			backlog += depth
+		}
+		awaitingInput := tracker.GetNumRoutinesAwaitingInput()
+		processing := tracker.GetNumRoutinesProcessing()
+		current := scaler.getTarget()
+		next := settings.decide(current, backlog, previousBacklog, int(awaitingInput), int(processing))
+		previousBacklog = backlog
+
+		if next == current || (!lastChange.IsZero() && time.Since(lastChange) < cooldown) {
+			continue
+		}
+		scaler.setTarget(next)
+		lastChange = time.Now()
+
+		if settings.Callback != nil {
+			if err := settings.Callback(&AutoScaleCallbackInput{
+				BaseExecutorCallbackInput: baseExecutorCallbackInput,
+				PreviousConcurrency:       current,
+				NewConcurrency:            next,
+				Backlog:                   backlog,
+				NumRoutinesAwaitingInput:  awaitingInput,
+				NumRoutinesProcessing:     processing,
+			}); err != nil {
+				fail(err)
+				return
+			}
+		}
+	}
+}
@@ -10,6 +10,20 @@ import (
 type BaseExecutorCallbackInput struct {
 	// The name of the executor
 	ExecutorName string
+	// For executors with ProcessUpstreamOutputsAfterUpstreamError, the outcome of
+	// processing the outputs of the upstream executor after it failed. Nil if the
+	// upstream executor didn't fail (or the option isn't used).
+	UpstreamErrorDrain *UpstreamErrorDrain
+	// How the time of the executor's routines was spent. Only set for the callbacks
+	// that are called once all routines have exited.
+	Utilization *Utilization
+}
+
+// clone returns a copy of the values, so that they can be set for one set of
+// callbacks without affecting the callbacks that run in other goroutines.
+func (b *BaseExecutorCallbackInput) clone() *BaseExecutorCallbackInput {
+	c := *b
+	return &c
 }
 
 type RoutineErrorCallbackInput struct {
@@ -42,6 +56,10 @@ type ExecutorContextDoneCallbackInput struct {
 	*BaseExecutorCallbackInput
 	// The context cancellation error (may wrap other info)
 	Err stackerr.Error
+	// The cause of the cancellation. This is the error of the executor that
+	// failed, the cause given to Cancel, or the cause of the cancellation of
+	// the input context.
+	Cause error
 }
 
 type EmptyInputChannelCallbackInput struct {
@@ -58,3 +76,50 @@ type FullOutputChannelCallbackInput struct {
 	// (i.e. resets at 0 for each input)
 	OutputIndex uint64
 }
+
+type PanicHandlerInput[InputType any] struct {
+	*RoutineFunctionMetadata
+	// The value that was recovered from the panic
+	Recovered any
+	// The stack at the point of the panic
+	Stack []byte
+	// The input that was being processed when the panic occurred (the
+	// zero value for processing functions that don't take an input)
+	Input InputType
+}
+
+type QuarantineCallbackInput[InputType any] struct {
+	*RoutineFunctionMetadata
+	// The input that has been requeued too many times
+	Input InputType
+}
+
+type RoutineRestartCallbackInput struct {
+	*RoutineFunctionMetadata
+	// The error that the routine failed with
+	Err stackerr.Error
+	// The number of restarts within the supervisor's window, including this one
+	Restarts int
+	// How long the routine waits before restarting
+	Backoff time.Duration
+}
+
+type StallCallbackInput struct {
+	*BaseExecutorCallbackInput
+	// What the routines of the stalled executor were doing
+	Report *StallReport
+}
+
+type AutoScaleCallbackInput struct {
+	*BaseExecutorCallbackInput
+	// The number of routines before the change
+	PreviousConcurrency int
+	// The number of routines after the change
+	NewConcurrency int
+	// The number of inputs that were waiting to be taken by a routine
+	Backlog int
+	// The number of routines that were waiting for an input
+	NumRoutinesAwaitingInput int32
+	// The number of routines that were processing an input
+	NumRoutinesProcessing int32
+}
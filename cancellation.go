@@ -0,0 +1,78 @@
+package concurrency
+
+import "sync/atomic"
+
+// CancellationPolicy decides what happens to the rest of a chain when
+// the processing function of an executor returns an error.
+type CancellationPolicy int
+
+const (
+	// The error cancels this executor, everything downstream of it and
+	// every upstream executor (and through them, every other executor
+	// consuming from them).
+	CancellationPolicyCancelUpstream CancellationPolicy = iota
+	// The error cancels this executor and everything downstream of it,
+	// but upstream executors keep running and feeding any other executors
+	// that consume their outputs. Errors in executors downstream of this
+	// one also stop here instead of cancelling upstream executors.
+	//
+	// Executors that are chained to the same upstream executor compete for
+	// its outputs: each output goes to only one of them, so a branch doesn't
+	// see every output. The outputs that an isolated executor had taken when
+	// it was cancelled are lost. If it was the last executor consuming the
+	// outputs of its upstream executor, the rest of those outputs are taken
+	// and dropped, so that the upstream executor can still finish.
+	CancellationPolicyIsolate
+	// The error is counted in the RoutineStatusTracker and the input
+	// that caused it is dropped, and the routine moves on to the next input.
+	CancellationPolicyIgnore
+)
+
+// addConsumer counts an executor that is chained to this one.
+func (eo *ExecutorOutput[OutputChanType]) addConsumer() {
+	atomic.AddInt32(&eo.numConsumers, 1)
+}
+
+// removeConsumer counts an executor that was chained to this one as having exited,
+// and returns whether it was the last one.
+func (eo *ExecutorOutput[OutputChanType]) removeConsumer() (last bool) {
+	return atomic.AddInt32(&eo.numConsumers, -1) == 0
+}
+
+// discardOutputs takes the outputs of the executor and drops them until its output
+// channel is closed, so that the executor doesn't get stuck waiting to output after
+// the executors that consumed its outputs have been cancelled.
+func (eo *ExecutorOutput[OutputChanType]) discardOutputs() {
+	edge := eo.trackedEdge
+	for {
+		if edge != nil {
+			<-edge.recvToken
+		}
+		_, ok := <-eo.OutputChan
+		if !ok {
+			if edge != nil {
+				edge.releaseRecv()
+			}
+			return
+		}
+		if edge != nil {
+			// The item is dropped, so it's done with
+			lineage := edge.pop()
+			edge.releaseRecv()
+			eo.itemTracker.release(lineage)
+		}
+	}
+}
+
+func (p CancellationPolicy) String() string {
+	switch p {
+	case CancellationPolicyCancelUpstream:
+		return "CancelUpstream"
+	case CancellationPolicyIsolate:
+		return "Isolate"
+	case CancellationPolicyIgnore:
+		return "Ignore"
+	default:
+		return "Unknown"
+	}
+}
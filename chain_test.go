@@ -2,9 +2,16 @@ package concurrency
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/Invicton-Labs/go-stackerr"
 )
@@ -203,3 +210,995 @@ func testExecutorIntoSlice(t *testing.T, numRoutines int, inputCount int) {
 	}
 	testVerifyCleanup(t, executor1)
 }
+
+func TestExecutorChainCompensate(t *testing.T) {
+	testMultiConcurrencies(t, "executor-chain-compensate", testExecutorChainCompensate)
+}
+
+func testExecutorChainCompensate(t *testing.T, numRoutines int) {
+	for _, batch := range []bool{false, true} {
+		for _, failAt := range []int{-1, 500} {
+			ctx := context.Background()
+			inputCount := 1000
+			var lock sync.Mutex
+			compensated := map[int]int{}
+			finished := map[int64]bool{}
+			executor1 := Executor(ctx, ExecutorInput[int, int]{
+				Name:              "test-executor-chain-compensate-1",
+				Concurrency:       numRoutines,
+				OutputChannelSize: 10,
+				InputChannel:      RangeToChan(0, inputCount),
+				Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+					return input, nil
+				},
+				Compensate: func(ctx context.Context, input int) stackerr.Error {
+					if ctx.Err() != nil {
+						t.Errorf("Compensate was called with a cancelled context")
+					}
+					lock.Lock()
+					compensated[input]++
+					lock.Unlock()
+					return nil
+				},
+			})
+			var executor3 *ExecutorOutput[int64]
+			if batch {
+				executor2 := ChainBatch(executor1, ExecutorBatchInput[int, int64]{
+					Name:              "test-executor-chain-compensate-2",
+					Concurrency:       numRoutines,
+					OutputChannelSize: 10,
+					BatchSize:         7,
+					Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int64, stackerr.Error) {
+						return int64(input), nil
+					},
+				})
+				executor3 = ChainUnbatch(executor2, ExecutorUnbatchInput[[]int64, int64]{
+					Name:              "test-executor-chain-compensate-3",
+					Concurrency:       numRoutines,
+					OutputChannelSize: 10,
+					Func: func(ctx context.Context, input []int64, metadata *RoutineFunctionMetadata) ([]int64, stackerr.Error) {
+						return input, nil
+					},
+				})
+			} else {
+				executor3 = Chain(executor1, ExecutorInput[int, int64]{
+					Name:              "test-executor-chain-compensate-3",
+					Concurrency:       numRoutines,
+					OutputChannelSize: 10,
+					Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int64, stackerr.Error) {
+						return int64(input), nil
+					},
+				})
+			}
+			executor4 := ChainFinal(executor3, ExecutorFinalInput[int64]{
+				Name:        "test-executor-chain-compensate-4",
+				Concurrency: 1,
+				Func: func(ctx context.Context, input int64, metadata *RoutineFunctionMetadata) stackerr.Error {
+					if input == int64(failAt) {
+						return stackerr.Errorf("test-error")
+					}
+					lock.Lock()
+					finished[input] = true
+					lock.Unlock()
+					return nil
+				},
+			})
+			err := executor4.Wait()
+			if failAt < 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(compensated) != 0 {
+					t.Fatalf("Compensated %d inputs for a chain that succeeded", len(compensated))
+				}
+				if len(finished) != inputCount {
+					t.Fatalf("Finished %d inputs, but expected %d", len(finished), inputCount)
+				}
+			} else {
+				if err == nil || err.Error() != "test-error" {
+					t.Fatalf("Expected a test-error error, but received %v", err)
+				}
+				if compensated[failAt] != 1 {
+					t.Fatalf("The input that failed was compensated %d times, but expected once", compensated[failAt])
+				}
+				for input, count := range compensated {
+					if count != 1 {
+						t.Fatalf("Input %d was compensated %d times", input, count)
+					}
+					// Inputs that were batched together are compensated as a group,
+					// so only non-batched inputs can be checked individually.
+					if !batch && finished[int64(input)] {
+						t.Fatalf("Input %d was compensated, but it finished", input)
+					}
+				}
+			}
+			testVerifyCleanup(t, executor1)
+			testVerifyCleanup(t, executor3)
+			testVerifyCleanup(t, executor4)
+		}
+	}
+}
+
+func TestExecutorChainCompensateRelease(t *testing.T) {
+	ctx := context.Background()
+	inputCount := 50000
+	executor1 := Executor(ctx, ExecutorInput[int, int]{
+		Name:         "test-executor-chain-compensate-release-1",
+		Concurrency:  4,
+		InputChannel: RangeToChan(0, inputCount),
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			return input, nil
+		},
+		Compensate: func(ctx context.Context, input int) stackerr.Error {
+			return nil
+		},
+	})
+	executor2 := Chain(executor1, ExecutorInput[int, int]{
+		Name:        "test-executor-chain-compensate-release-2",
+		Concurrency: 4,
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			return input, nil
+		},
+	})
+	// The outputs of the last executor are read outside of the chain
+	numOutput := 0
+	for range executor2.OutputChan {
+		numOutput++
+	}
+	if err := executor2.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if numOutput != inputCount {
+		t.Fatalf("Received %d outputs, but expected %d", numOutput, inputCount)
+	}
+	// Nothing is kept for the items once they've left the chain
+	tracker := executor2.itemTracker
+	if len(tracker.refs) != 0 || len(tracker.records) != 0 || len(tracker.recordsByRoot) != 0 {
+		t.Fatalf("Expected nothing to be tracked, but there are %d roots, %d records and %d roots with records", len(tracker.refs), len(tracker.records), len(tracker.recordsByRoot))
+	}
+	if len(executor1.trackedEdge.lineages) != 0 || len(executor2.trackedEdge.lineages) != 0 {
+		t.Fatalf("Expected no lineages on the edges, but there are %d and %d", len(executor1.trackedEdge.lineages), len(executor2.trackedEdge.lineages))
+	}
+	testVerifyCleanup(t, executor1)
+	testVerifyCleanup(t, executor2)
+
+	// Without a Compensate function, items aren't tracked at all
+	executor1 = Executor(ctx, ExecutorInput[int, int]{
+		Name:         "test-executor-chain-compensate-release-3",
+		InputChannel: RangeToChan(0, 10),
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			return input, nil
+		},
+	})
+	executor2 = Chain(executor1, ExecutorInput[int, int]{
+		Name:              "test-executor-chain-compensate-release-4",
+		OutputChannelSize: 10,
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			return input, nil
+		},
+	})
+	if err := executor2.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if executor2.itemTracker != nil || executor1.trackedEdge != nil || executor2.trackedEdge != nil {
+		t.Fatalf("Expected no item tracking without a Compensate function")
+	}
+	testVerifyCleanup(t, executor1)
+	testVerifyCleanup(t, executor2)
+}
+
+func TestExecutorChainCompensateDropped(t *testing.T) {
+	ctx := context.Background()
+	inputCount := 100
+	// Each downstream executor drops the odd inputs in a different way
+	downstreams := map[string]ExecutorInput[int, int]{
+		"skip": {
+			Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+				if input%2 == 1 {
+					panic("odd input")
+				}
+				return input, nil
+			},
+			PanicHandler: func(input *PanicHandlerInput[int]) PanicAction {
+				return PanicActionSkip
+			},
+		},
+		"quarantine": {
+			MaxRequeues: 1,
+			Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+				if input%2 == 1 {
+					return 0, Requeue(0)
+				}
+				return input, nil
+			},
+			QuarantineCallback: func(input *QuarantineCallbackInput[int]) stackerr.Error {
+				return nil
+			},
+		},
+		"ignore": {
+			CancellationPolicy: CancellationPolicyIgnore,
+			Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+				if input%2 == 1 {
+					return 0, stackerr.Errorf("odd input")
+				}
+				return input, nil
+			},
+		},
+	}
+	for name, downstream := range downstreams {
+		executor1 := Executor(ctx, ExecutorInput[int, int]{
+			Name:         "test-executor-chain-compensate-dropped-" + name + "-1",
+			Concurrency:  4,
+			InputChannel: RangeToChan(0, inputCount),
+			Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+				return input, nil
+			},
+			Compensate: func(ctx context.Context, input int) stackerr.Error {
+				return nil
+			},
+		})
+		downstream.Name = "test-executor-chain-compensate-dropped-" + name + "-2"
+		downstream.Concurrency = 4
+		downstream.OutputChannelSize = inputCount
+		executor2 := Chain(executor1, downstream)
+		if err := executor2.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		if len(executor2.OutputChan) != inputCount/2 {
+			t.Fatalf("%s: Received %d outputs, but expected %d", name, len(executor2.OutputChan), inputCount/2)
+		}
+		// The dropped inputs don't keep anything in the tracker
+		tracker := executor2.itemTracker
+		if len(tracker.refs) != 0 || len(tracker.records) != 0 || len(tracker.recordsByRoot) != 0 {
+			t.Fatalf("%s: Expected nothing to be tracked, but there are %d roots, %d records and %d roots with records", name, len(tracker.refs), len(tracker.records), len(tracker.recordsByRoot))
+		}
+		testVerifyCleanup(t, executor1)
+		testVerifyCleanup(t, executor2)
+	}
+}
+
+func TestExecutorChainResult(t *testing.T) {
+	testMultiConcurrenciesMultiInput(t, "executor-chain-result", testExecutorChainResult)
+}
+
+func testExecutorChainResult(t *testing.T, numRoutines int, inputCount int) {
+	ctx := context.Background()
+	inputChan := make(chan int, inputCount)
+	for i := 1; i <= inputCount; i++ {
+		inputChan <- i
+	}
+	close(inputChan)
+	executor1 := ExecutorResult(ctx, ExecutorResultInput[int, uint]{
+		Name:              "test-executor-chain-result-1",
+		Concurrency:       numRoutines,
+		OutputChannelSize: inputCount,
+		InputChannel:      inputChan,
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (output uint, err stackerr.Error) {
+			if input%3 == 0 {
+				return 0, stackerr.Errorf("divisible by 3")
+			}
+			return uint(input), nil
+		},
+		EmptyInputChannelCallback: testEmptyInputCallback,
+		FullOutputChannelCallback: testFullOutputCallback,
+	})
+	var processed int32 = 0
+	executor2 := ChainResult(executor1, ChainResultInput[uint, string]{
+		Name:              "test-executor-chain-result-2",
+		Concurrency:       numRoutines,
+		OutputChannelSize: inputCount,
+		Func: func(ctx context.Context, input Result[uint], metadata *RoutineFunctionMetadata) (output string, err stackerr.Error) {
+			atomic.AddInt32(&processed, 1)
+			if input.Err != nil {
+				return "", stackerr.Errorf("received an errored result")
+			}
+			if input.Value%5 == 0 {
+				return "", stackerr.Errorf("divisible by 5")
+			}
+			return strconv.Itoa(int(input.Value)), nil
+		},
+		EmptyInputChannelCallback: testEmptyInputCallback,
+		FullOutputChannelCallback: testFullOutputCallback,
+	})
+	successes := 0
+	failures := map[string]int{}
+	executor3 := ChainFinal(executor2, ExecutorFinalInput[Result[string]]{
+		Name:        "test-executor-chain-result-3",
+		Concurrency: 1,
+		Func: func(ctx context.Context, input Result[string], metadata *RoutineFunctionMetadata) (err stackerr.Error) {
+			if input.Err != nil {
+				failures[input.ExecutorName]++
+				return nil
+			}
+			if input.ExecutorName != "test-executor-chain-result-2" {
+				return stackerr.Errorf("unexpected executor name %q", input.ExecutorName)
+			}
+			successes++
+			return nil
+		},
+		EmptyInputChannelCallback: testEmptyInputCallback,
+		FullOutputChannelCallback: testFullOutputCallback,
+	})
+	err := executor3.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedFailures1, expectedFailures2 := 0, 0
+	for i := 1; i <= inputCount; i++ {
+		if i%3 == 0 {
+			expectedFailures1++
+		} else if i%5 == 0 {
+			expectedFailures2++
+		}
+	}
+	if failures["test-executor-chain-result-1"] != expectedFailures1 {
+		t.Fatalf("Received %d failures from the first executor, but expected %d", failures["test-executor-chain-result-1"], expectedFailures1)
+	}
+	if failures["test-executor-chain-result-2"] != expectedFailures2 {
+		t.Fatalf("Received %d failures from the second executor, but expected %d", failures["test-executor-chain-result-2"], expectedFailures2)
+	}
+	if successes != inputCount-expectedFailures1-expectedFailures2 {
+		t.Fatalf("Received %d successes, but expected %d", successes, inputCount-expectedFailures1-expectedFailures2)
+	}
+	if int(processed) != inputCount-expectedFailures1 {
+		t.Fatalf("Second executor processed %d inputs, but expected %d", processed, inputCount-expectedFailures1)
+	}
+	testVerifyCleanup(t, executor1)
+	testVerifyCleanup(t, executor2)
+	testVerifyCleanup(t, executor3)
+}
+
+func TestExecutorChainIsolate(t *testing.T) {
+	testMultiConcurrencies(t, "executor-chain-isolate", testExecutorChainIsolate)
+}
+
+func testExecutorChainIsolate(t *testing.T, numRoutines int) {
+	ctx := context.Background()
+	inputCount := 1000
+	executor1 := Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-chain-isolate-1",
+		Concurrency:       numRoutines,
+		OutputChannelSize: 10,
+		InputChannel:      RangeToChan(0, inputCount),
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			return input, nil
+		},
+	})
+	// The main branch, which must not be affected by the audit branch failing. It
+	// doesn't process anything until the audit branch has failed.
+	auditFailed := make(chan struct{})
+	var mainProcessed int32 = 0
+	mainExecutor := ChainFinal(executor1, ExecutorFinalInput[int]{
+		Name: "test-executor-chain-isolate-main",
+		// Few enough routines that they can't hold every input while waiting
+		Concurrency: 10,
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) stackerr.Error {
+			<-auditFailed
+			atomic.AddInt32(&mainProcessed, 1)
+			return nil
+		},
+	})
+	// The audit branch, which is isolated and fails on its first input
+	auditExecutor1 := Chain(executor1, ExecutorInput[int, int]{
+		Name:               "test-executor-chain-isolate-audit-1",
+		Concurrency:        1,
+		OutputChannelSize:  1,
+		CancellationPolicy: CancellationPolicyIsolate,
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			return input, nil
+		},
+	})
+	var auditProcessed int32 = 0
+	auditExecutor2 := ChainFinal(auditExecutor1, ExecutorFinalInput[int]{
+		Name:        "test-executor-chain-isolate-audit-2",
+		Concurrency: 1,
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) stackerr.Error {
+			atomic.AddInt32(&auditProcessed, 1)
+			close(auditFailed)
+			return stackerr.Errorf("test-error")
+		},
+	})
+	err := auditExecutor2.Wait()
+	if err == nil || err.Error() != "test-error" {
+		t.Fatalf("Expected a test-error error from the audit branch, but received %v", err)
+	}
+	if err := mainExecutor.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := executor1.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// The branches compete for the outputs of the first executor, so each input goes
+	// to only one of them. Up to two inputs can be lost in the audit branch when it's
+	// cancelled (one in its first executor's routine and one in its output channel).
+	if total := int(mainProcessed + auditProcessed); total > inputCount || total < inputCount-2 {
+		t.Fatalf("Processed %d inputs across both branches, but expected between %d and %d", total, inputCount-2, inputCount)
+	}
+	testVerifyCleanup(t, executor1)
+	testVerifyCleanup(t, mainExecutor)
+	testVerifyCleanup(t, auditExecutor1)
+	testVerifyCleanup(t, auditExecutor2)
+
+	// If the isolated executor is the only one consuming the outputs of the first
+	// executor, the rest of them are dropped once it fails, so the first executor
+	// can still finish.
+	executor1 = Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-chain-isolate-2",
+		Concurrency:       numRoutines,
+		OutputChannelSize: 10,
+		InputChannel:      RangeToChan(0, inputCount),
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			return input, nil
+		},
+	})
+	isolatedExecutor := ChainFinal(executor1, ExecutorFinalInput[int]{
+		Name:               "test-executor-chain-isolate-only",
+		Concurrency:        1,
+		CancellationPolicy: CancellationPolicyIsolate,
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) stackerr.Error {
+			return stackerr.Errorf("test-error")
+		},
+	})
+	err = isolatedExecutor.Wait()
+	if err == nil || err.Error() != "test-error" {
+		t.Fatalf("Expected a test-error error from the isolated executor, but received %v", err)
+	}
+	upstreamDone := make(chan stackerr.Error, 1)
+	go func() {
+		upstreamDone <- executor1.Wait()
+	}()
+	select {
+	case err := <-upstreamDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("The upstream executor didn't finish after the only executor consuming its outputs failed")
+	}
+	if processed := executor1.RoutineStatusTracker.GetNumProcessed(); processed != uint64(inputCount) {
+		t.Fatalf("The upstream executor processed %d inputs, but expected %d", processed, inputCount)
+	}
+	testVerifyCleanup(t, executor1)
+	testVerifyCleanup(t, isolatedExecutor)
+}
+
+func TestExecutorChainCancel(t *testing.T) {
+	testMultiConcurrencies(t, "executor-chain-cancel", testExecutorChainCancel)
+}
+
+func testExecutorChainCancel(t *testing.T, numRoutines int) {
+	causeErr := errors.New("test-cause")
+
+	// Cancel a running chain from outside with a cause
+	{
+		ctx := context.Background()
+		executor1 := Executor(ctx, ExecutorInput[int, int]{
+			Name:              "test-executor-chain-cancel-1",
+			Concurrency:       numRoutines,
+			OutputChannelSize: 10,
+			InputChannel:      RangeToChan(0, 100000),
+			Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+				return input, nil
+			},
+		})
+		var contextDoneCause error
+		executor2 := Chain(executor1, ExecutorInput[int, int]{
+			Name:              "test-executor-chain-cancel-2",
+			Concurrency:       numRoutines,
+			OutputChannelSize: 10,
+			Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+				return input, nil
+			},
+			ExecutorContextDoneCallback: func(input *ExecutorContextDoneCallbackInput) stackerr.Error {
+				contextDoneCause = input.Cause
+				return nil
+			},
+		})
+		var received int32 = 0
+		reached := make(chan struct{})
+		executor3 := ChainFinal(executor2, ExecutorFinalInput[int]{
+			Name:        "test-executor-chain-cancel-3",
+			Concurrency: 1,
+			Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) stackerr.Error {
+				received++
+				if received == 100 {
+					close(reached)
+				}
+				if received >= 100 {
+					<-ctx.Done()
+				}
+				return nil
+			},
+		})
+		<-reached
+		executor3.Cancel(causeErr)
+		err := executor3.Wait()
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected a context cancelled error, but received %v", err)
+		}
+		if !errors.Is(err, causeErr) {
+			t.Fatalf("Expected the error to wrap the cancellation cause, but received %v", err)
+		}
+		if !errors.Is(contextDoneCause, causeErr) {
+			t.Fatalf("Expected the context done callback to receive the cancellation cause, but received %v", contextDoneCause)
+		}
+		for _, c := range []context.Context{executor1.Ctx(), executor2.Ctx(), executor3.Ctx()} {
+			if cause := context.Cause(c); !errors.Is(cause, causeErr) {
+				t.Fatalf("Expected the context cause to be the cancellation cause, but received %v", cause)
+			}
+		}
+		testVerifyCleanup(t, executor1)
+		testVerifyCleanup(t, executor2)
+		testVerifyCleanup(t, executor3)
+	}
+
+	// A failing executor cancels the upstream executors with its error as the cause
+	{
+		ctx := context.Background()
+		var contextDoneCause error
+		executor1 := Executor(ctx, ExecutorInput[int, int]{
+			Name:              "test-executor-chain-cancel-cause-1",
+			Concurrency:       numRoutines,
+			OutputChannelSize: 10,
+			InputChannel:      RangeToChan(0, 100000),
+			Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+				return input, nil
+			},
+			ExecutorContextDoneCallback: func(input *ExecutorContextDoneCallbackInput) stackerr.Error {
+				contextDoneCause = input.Cause
+				return nil
+			},
+		})
+		executor2 := ChainFinal(executor1, ExecutorFinalInput[int]{
+			Name:        "test-executor-chain-cancel-cause-2",
+			Concurrency: 1,
+			Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) stackerr.Error {
+				if input == 100 {
+					return stackerr.Wrap(causeErr)
+				}
+				return nil
+			},
+		})
+		if err := executor2.Wait(); !errors.Is(err, causeErr) {
+			t.Fatalf("Expected the test cause error, but received %v", err)
+		}
+		if err := executor1.Wait(); !errors.Is(err, context.Canceled) || !errors.Is(err, causeErr) {
+			t.Fatalf("Expected a context cancelled error caused by the test cause error, but received %v", err)
+		}
+		if !errors.Is(contextDoneCause, causeErr) {
+			t.Fatalf("Expected the context done callback to receive the failing executor's error, but received %v", contextDoneCause)
+		}
+		testVerifyCleanup(t, executor1)
+		testVerifyCleanup(t, executor2)
+	}
+}
+
+func TestExecutorChainPause(t *testing.T) {
+	ctx := context.Background()
+	inputCount := 1000
+	executor1 := Executor(ctx, ExecutorInput[int, int]{
+		Name:         "test-executor-chain-pause-1",
+		Concurrency:  10,
+		InputChannel: RangeToChan(0, inputCount),
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			return input, nil
+		},
+	})
+	var received int32 = 0
+	executor2 := ChainFinal(executor1, ExecutorFinalInput[int]{
+		Name:        "test-executor-chain-pause-2",
+		Concurrency: 10,
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) stackerr.Error {
+			atomic.AddInt32(&received, 1)
+			return nil
+		},
+	})
+	executor2.PauseChain()
+	deadline := time.Now().Add(10 * time.Second)
+	for executor1.RoutineStatusTracker.GetNumRoutinesPaused() != 10 || executor2.RoutineStatusTracker.GetNumRoutinesPaused() != 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected all routines in the chain to be paused")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !executor1.IsPaused() || !executor2.IsPaused() {
+		t.Fatalf("Expected all executors in the chain to be paused")
+	}
+	before := atomic.LoadInt32(&received)
+	time.Sleep(20 * time.Millisecond)
+	if after := atomic.LoadInt32(&received); after != before || int(after) == inputCount {
+		t.Fatalf("Expected nothing to be processed while paused, but %d inputs were received (%d before)", after, before)
+	}
+	executor2.ResumeChain()
+	if err := executor2.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if r := atomic.LoadInt32(&received); int(r) != inputCount {
+		t.Fatalf("Received %d inputs, but expected %d", r, inputCount)
+	}
+}
+
+func TestExecutorChainDrain(t *testing.T) {
+	testMultiConcurrencies(t, "executor-chain-drain", testExecutorChainDrain)
+}
+func testExecutorChainDrain(t *testing.T, numRoutines int) {
+	ctx := context.Background()
+	var produced int64 = 0
+	executor1 := Continuous(ctx, ContinuousInput[int64]{
+		Name:        "test-executor-chain-drain-1",
+		Concurrency: numRoutines,
+		Func: func(ctx context.Context, metadata *RoutineFunctionMetadata) (int64, stackerr.Error) {
+			return atomic.AddInt64(&produced, 1), nil
+		},
+	}, 0)
+	executor2 := ChainBatch(executor1, ExecutorBatchInput[int64, int64]{
+		Name:        "test-executor-chain-drain-2",
+		Concurrency: numRoutines,
+		BatchSize:   7,
+		Func: func(ctx context.Context, input int64, metadata *RoutineFunctionMetadata) (int64, stackerr.Error) {
+			return input, nil
+		},
+	})
+	var received int64 = 0
+	reached := make(chan struct{})
+	var reachedOnce sync.Once
+	executor3 := ChainFinal(executor2, ExecutorFinalInput[[]int64]{
+		Name:        "test-executor-chain-drain-3",
+		Concurrency: 1,
+		Func: func(ctx context.Context, input []int64, metadata *RoutineFunctionMetadata) stackerr.Error {
+			if atomic.AddInt64(&received, int64(len(input))) >= 1000 {
+				reachedOnce.Do(func() {
+					close(reached)
+				})
+			}
+			return nil
+		},
+	})
+	<-reached
+	executor3.Drain()
+	if err := executor3.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// Everything that was produced made it to the end, including the final partial batch
+	if p, r := atomic.LoadInt64(&produced), atomic.LoadInt64(&received); p != r {
+		t.Fatalf("Produced %d outputs, but received %d", p, r)
+	}
+	testVerifyCleanup(t, executor1)
+	testVerifyCleanup(t, executor2)
+	testVerifyCleanup(t, executor3)
+}
+
+func TestExecutorChainShutdown(t *testing.T) {
+	// A chain that drains within the grace period shuts down cleanly
+	{
+		ctx := context.Background()
+		executor1 := Continuous(ctx, ContinuousInput[int]{
+			Name:        "test-executor-chain-shutdown-clean-1",
+			Concurrency: 10,
+			Func: func(ctx context.Context, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+				return 1, nil
+			},
+		}, 0)
+		executor2 := ChainFinal(executor1, ExecutorFinalInput[int]{
+			Name:        "test-executor-chain-shutdown-clean-2",
+			Concurrency: 10,
+			Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) stackerr.Error {
+				return nil
+			},
+		})
+		shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		if err := executor2.Shutdown(shutdownCtx); err != nil {
+			t.Fatalf("Expected a clean shutdown, but received %v", err)
+		}
+		testVerifyCleanup(t, executor1)
+		testVerifyCleanup(t, executor2)
+	}
+
+	// A chain that can't drain within the grace period gets cancelled
+	{
+		ctx := context.Background()
+		executor1 := Continuous(ctx, ContinuousInput[int]{
+			Name:        "test-executor-chain-shutdown-forced-1",
+			Concurrency: 10,
+			Func: func(ctx context.Context, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+				return 1, nil
+			},
+		}, 0)
+		reached := make(chan struct{})
+		var reachedOnce sync.Once
+		executor2 := ChainFinal(executor1, ExecutorFinalInput[int]{
+			Name:        "test-executor-chain-shutdown-forced-2",
+			Concurrency: 10,
+			Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) stackerr.Error {
+				reachedOnce.Do(func() {
+					close(reached)
+				})
+				// Stuck until the chain is cancelled
+				<-ctx.Done()
+				return nil
+			},
+		})
+		<-reached
+		shutdownCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		err := executor2.Shutdown(shutdownCtx)
+		var shutdownErr *ShutdownError
+		if !errors.As(err, &shutdownErr) {
+			t.Fatalf("Expected a shutdown error, but received %v", err)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expected the shutdown error to wrap the deadline error, but received %v", err)
+		}
+		busy := false
+		for _, stage := range shutdownErr.BusyStages {
+			if stage.ExecutorName == executor2.Name && stage.NumRoutinesProcessing > 0 {
+				busy = true
+			}
+		}
+		if !busy {
+			t.Fatalf("Expected %s to be reported as busy, but got %+v", executor2.Name, shutdownErr.BusyStages)
+		}
+		if cause := context.Cause(executor2.Ctx()); !errors.As(cause, &shutdownErr) {
+			t.Fatalf("Expected the chain to be cancelled with the shutdown error, but the cause is %v", cause)
+		}
+		testVerifyCleanup(t, executor1)
+		testVerifyCleanup(t, executor2)
+	}
+}
+
+func TestExecutorChainUpstreamErrorDrain(t *testing.T) {
+	upstreamErr := errors.New("test-upstream-error")
+	run := func(name string, timeout time.Duration, maxItems int) (*UpstreamErrorDrain, stackerr.Error) {
+		ctx := context.Background()
+		// The upstream executor outputs 500 values, and then fails
+		executor1 := Executor(ctx, ExecutorInput[int, int]{
+			Name:              name + "-1",
+			Concurrency:       1,
+			OutputChannelSize: 1000,
+			InputChannel:      RangeToChan(0, 1000),
+			Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+				if input == 500 {
+					return 0, stackerr.Wrap(upstreamErr)
+				}
+				return input, nil
+			},
+		})
+		var drain *UpstreamErrorDrain
+		executor2 := ChainFinal(executor1, ExecutorFinalInput[int]{
+			Name:                                     name + "-2",
+			Concurrency:                              1,
+			ProcessUpstreamOutputsAfterUpstreamError: true,
+			UpstreamErrorDrainTimeout:                timeout,
+			UpstreamErrorDrainMaxItems:               maxItems,
+			Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) stackerr.Error {
+				if input == 0 {
+					// Don't start processing until the upstream executor has failed
+					<-executor1.Errored()
+					time.Sleep(10 * time.Millisecond)
+				} else if timeout > 0 {
+					time.Sleep(time.Millisecond)
+				}
+				return nil
+			},
+			ExecutorContextDoneCallback: func(input *ExecutorContextDoneCallbackInput) stackerr.Error {
+				drain = input.UpstreamErrorDrain
+				return nil
+			},
+		})
+		err := executor2.Wait()
+		if !errors.Is(err, upstreamErr) {
+			t.Fatalf("%s: expected the upstream error, but received %v", name, err)
+		}
+		if drain == nil {
+			t.Fatalf("%s: expected the drain to be reported", name)
+		}
+		return drain, err
+	}
+
+	// The first output may or may not have been taken before the upstream executor
+	// failed, so either 499 or all 500 outputs are taken after it failed.
+	minimum := uint64(499)
+
+	// Without limits, everything the upstream executor output is processed
+	drain, _ := run("test-executor-chain-upstream-error-drain", 0, 0)
+	if drain.Err != nil || drain.Abandoned != 0 || drain.Drained < minimum {
+		t.Fatalf("Expected all inputs to be drained and none abandoned, but got %+v", drain)
+	}
+
+	// The drain stops after the maximum number of inputs
+	drain, _ = run("test-executor-chain-upstream-error-drain-max-items", 0, 100)
+	if !errors.Is(drain.Err, ErrUpstreamErrorDrainMaxItems) {
+		t.Fatalf("Expected the drain to stop at the maximum number of inputs, but got %v", drain.Err)
+	}
+	if drain.Drained != 100 || drain.Drained+drain.Abandoned < minimum {
+		t.Fatalf("Expected 100 inputs to be drained and the rest abandoned, but got %+v", drain)
+	}
+
+	// The drain stops after the timeout
+	drain, _ = run("test-executor-chain-upstream-error-drain-timeout", 50*time.Millisecond, 0)
+	if !errors.Is(drain.Err, ErrUpstreamErrorDrainTimeout) {
+		t.Fatalf("Expected the drain to time out, but got %v", drain.Err)
+	}
+	if drain.Abandoned == 0 || drain.Drained+drain.Abandoned < minimum {
+		t.Fatalf("Expected some inputs to be abandoned and the rest drained, but got %+v", drain)
+	}
+}
+
+func TestExecutorChainHealth(t *testing.T) {
+	ctx := context.Background()
+	inputChan := make(chan int, 10)
+	unblock := make(chan struct{})
+	var reached int32 = 0
+	executor1 := Executor(ctx, ExecutorInput[int, int]{
+		Name:         "test-executor-chain-health-1",
+		Concurrency:  1,
+		InputChannel: inputChan,
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			if input%5 == 0 {
+				return 0, stackerr.Errorf("error on input %d", input)
+			}
+			return input, nil
+		},
+		Fallback: func(ctx context.Context, input int, err stackerr.Error, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			return input, nil
+		},
+	})
+	executor2 := ChainFinal(executor1, ExecutorFinalInput[int]{
+		Name:        "test-executor-chain-health-2",
+		Concurrency: 1,
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) stackerr.Error {
+			if input == 7 {
+				atomic.StoreInt32(&reached, 1)
+				<-unblock
+			}
+			return nil
+		},
+	})
+	rules := HealthRules{
+		MaxErrors:              2,
+		MaxTimeWithoutProgress: 20 * time.Millisecond,
+	}
+
+	// Without any work, the chain is healthy and ready
+	report := executor2.Health(rules)
+	if !report.Healthy || !report.Ready || len(report.Stages) != 2 {
+		t.Fatalf("Expected a healthy and ready chain with 2 stages, but got %+v", report)
+	}
+
+	// The second executor gets stuck on an input, and the first one reaches
+	// the maximum number of errors.
+	for i := 0; i < 10; i++ {
+		inputChan <- i
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt32(&reached) == 0 || executor1.RoutineStatusTracker.GetNumErrors() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the second executor to get stuck and the first to have 2 errors")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	recorder := httptest.NewRecorder()
+	executor2.HealthHandler(rules).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a %d status, but got %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+	var served struct {
+		Healthy bool
+		Stages  []struct {
+			State     string
+			NumErrors uint64 `json:"num_errors"`
+			Problems  []string
+		}
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if served.Healthy || len(served.Stages) != 2 {
+		t.Fatalf("Expected an unhealthy chain with 2 stages, but got %s", recorder.Body.String())
+	}
+	if served.Stages[0].State != "Running" || served.Stages[0].NumErrors != 2 || len(served.Stages[0].Problems) != 1 {
+		t.Fatalf("Expected the first stage to be running with 2 errors, but got %+v", served.Stages[0])
+	}
+	if served.Stages[1].State != "Stalled" || len(served.Stages[1].Problems) != 1 {
+		t.Fatalf("Expected the second stage to be stalled, but got %+v", served.Stages[1])
+	}
+
+	// While draining, the chain isn't ready
+	close(unblock)
+	executor2.Drain()
+	recorder = httptest.NewRecorder()
+	executor2.ReadinessHandler(HealthRules{}).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a %d status while draining, but got %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+
+	// Once it's finished, the chain is still healthy, but not ready
+	if err := executor2.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	report = executor2.Health(HealthRules{})
+	if !report.Healthy || report.Ready {
+		t.Fatalf("Expected a healthy chain that isn't ready, but got %+v", report)
+	}
+	for _, stage := range report.Stages {
+		if stage.State != StageStateFinished {
+			t.Fatalf("Expected all stages to be finished, but got %+v", stage)
+		}
+	}
+	testVerifyCleanup(t, executor1)
+	testVerifyCleanup(t, executor2)
+}
+
+func TestExecutorChainAnalyze(t *testing.T) {
+	ctx := context.Background()
+	inputCount := 300
+	executor1 := Executor(ctx, ExecutorInput[int, int]{
+		Name:         "test-executor-chain-analyze-1",
+		Concurrency:  2,
+		InputChannel: RangeToChan(0, inputCount),
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			return input, nil
+		},
+	})
+	// The slow stage in the middle
+	executor2 := Chain(executor1, ExecutorInput[int, int]{
+		Name:        "test-executor-chain-analyze-2",
+		Concurrency: 1,
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			time.Sleep(2 * time.Millisecond)
+			return input, nil
+		},
+	})
+	executor3 := ChainFinal(executor2, ExecutorFinalInput[int]{
+		Name:        "test-executor-chain-analyze-3",
+		Concurrency: 2,
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) stackerr.Error {
+			return nil
+		},
+	})
+
+	report, err := executor3.Analyze(ctx, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Stages) != 3 {
+		t.Fatalf("Expected 3 stages in the report, but got %d", len(report.Stages))
+	}
+	if report.Bottleneck == nil || report.Bottleneck.ExecutorName != "test-executor-chain-analyze-2" {
+		t.Fatalf("Expected the second stage to be the bottleneck, but got %+v", report.Bottleneck)
+	}
+	if report.Bottleneck != report.Stages[0] || report.Bottleneck.SuggestedConcurrency <= 1 || report.Bottleneck.Throughput <= 0 {
+		t.Fatalf("Expected more routines to be suggested for the bottleneck, but got %+v", report.Bottleneck)
+	}
+	if len(report.Starved) != 1 || report.Starved[0].ExecutorName != "test-executor-chain-analyze-3" {
+		t.Fatalf("Expected the last stage to be starved, but got %+v", report.Starved)
+	}
+	for _, stage := range report.Stages {
+		if stage.Stage == 0 && stage.Utilization.AwaitingOutput < 0.5 {
+			t.Fatalf("Expected the first stage to be waiting to output, but got %+v", stage.Utilization)
+		}
+	}
+
+	if err := executor3.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	testVerifyCleanup(t, executor1)
+	testVerifyCleanup(t, executor2)
+	testVerifyCleanup(t, executor3)
+
+	// The analysis stops when the context is done
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := executor3.Analyze(cancelledCtx, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a context error, but received %v", err)
+	}
+
+	// A window that isn't greater than 0 can't be analyzed
+	for _, window := range []time.Duration{0, -time.Second} {
+		if report, err := executor3.Analyze(ctx, window); report != nil || !errors.Is(err, ErrAnalyzeWindow) {
+			t.Fatalf("Expected an analysis window error for a window of %s, but received %v", window, err)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package concurrency
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+// CompensationError is returned by the last executor in a chain when the chain
+// failed and one or more Compensate functions also returned an error.
+type CompensationError struct {
+	// The error that caused the chain to fail
+	Err stackerr.Error
+	// The errors returned by Compensate functions
+	CompensationErrs []stackerr.Error
+}
+
+func (ce *CompensationError) Error() string {
+	msgs := make([]string, len(ce.CompensationErrs))
+	for i, err := range ce.CompensationErrs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%s (compensation also failed: %s)", ce.Err.Error(), strings.Join(msgs, "; "))
+}
+
+func (ce *CompensationError) Unwrap() error {
+	return ce.Err
+}
+
+// The lineage of an item that is flowing through a tracked chain, which
+// is the set of root item IDs that the item was derived from.
+type trackedItem struct {
+	lineage []uint64
+}
+
+// A record of an input that was completed by an executor with a Compensate function.
+type compensationRecord struct {
+	// The position of the executor in the chain
+	stage int
+	// The order in which the record was created
+	seq uint64
+	// The roots of the input that was completed
+	lineage []uint64
+	// The number of roots that haven't finished yet
+	remaining int
+	// Calls the executor's Compensate function with the input
+	compensate func(ctx context.Context) stackerr.Error
+}
+
+// itemTracker tracks items through a chain, from the first executor that has a
+// Compensate function, so that the completed inputs whose downstream processing
+// did not finish can be compensated if the chain fails.
+//
+// Each input taken by the first tracked executor gets a root ID. Every item derived
+// from it (outputs, batches containing it, etc.) carries that root ID in its lineage.
+// The tracker counts the live references to each root: items being processed, items
+// held in a batch, and items sitting in an output channel. A root is finished once
+// there are no live references left. Items that are put into the output channel of
+// the last executor in the chain have left the chain, so they don't hold references,
+// and a root's records are dropped as soon as it finishes.
+type itemTracker struct {
+	lock sync.Mutex
+	// The context to pass to the Compensate functions. It has the values of the context
+	// that the first tracked executor was created with, but never gets cancelled.
+	ctx context.Context
+	// The ID to give to the next root
+	nextRoot uint64
+	// The number of live references to each unfinished root
+	refs map[uint64]int
+	// The records that have unfinished roots
+	records map[*compensationRecord]struct{}
+	// The records for each unfinished root
+	recordsByRoot map[uint64][]*compensationRecord
+	// The number of records that have been created
+	nextSeq uint64
+	// The number of tracked executors that haven't exited yet
+	numStagesRunning int
+	// Whether any tracked executor exited with an error
+	failed bool
+}
+
+func newItemTracker(ctx context.Context) *itemTracker {
+	// The Compensate functions run after the chain has failed, so they get a context
+	// that has the same values but isn't cancelled.
+	compensateCtx, _ := newExecutorContext(ctx)
+	return &itemTracker{
+		ctx:           compensateCtx,
+		refs:          map[uint64]int{},
+		records:       map[*compensationRecord]struct{}{},
+		recordsByRoot: map[uint64][]*compensationRecord{},
+	}
+}
+
+// register adds an executor to the chain.
+func (it *itemTracker) register() {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	it.numStagesRunning++
+}
+
+// newRoot creates a new root for an input that's being processed.
+func (it *itemTracker) newRoot() []uint64 {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	root := it.nextRoot
+	it.nextRoot++
+	it.refs[root] = 1
+	return []uint64{root}
+}
+
+// hold adds a reference to each root in the lineage.
+func (it *itemTracker) hold(lineage []uint64) {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	for _, root := range lineage {
+		it.refs[root]++
+	}
+}
+
+// release removes a reference to each root in the lineage, finishing any roots
+// that no longer have any references.
+func (it *itemTracker) release(lineage []uint64) {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	for _, root := range lineage {
+		it.refs[root]--
+		if it.refs[root] <= 0 {
+			it.finishRoot(root)
+		}
+	}
+}
+
+// finishRoot removes a root that has no more references. Must be called with the lock held.
+func (it *itemTracker) finishRoot(root uint64) {
+	delete(it.refs, root)
+	for _, record := range it.recordsByRoot[root] {
+		record.remaining--
+		if record.remaining == 0 {
+			delete(it.records, record)
+		}
+	}
+	delete(it.recordsByRoot, root)
+}
+
+// record saves an input that was completed by an executor with a Compensate function.
+func (it *itemTracker) record(stage int, lineage []uint64, compensate func(ctx context.Context) stackerr.Error) {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	record := &compensationRecord{
+		stage:      stage,
+		seq:        it.nextSeq,
+		lineage:    lineage,
+		compensate: compensate,
+	}
+	it.nextSeq++
+	for _, root := range lineage {
+		// Roots that have already finished don't need to be tracked
+		if _, ok := it.refs[root]; ok {
+			record.remaining++
+			it.recordsByRoot[root] = append(it.recordsByRoot[root], record)
+		}
+	}
+	if record.remaining > 0 {
+		it.records[record] = struct{}{}
+	}
+}
+
+// stageExited is called when the last routine of a tracked executor exits. If it's
+// the last tracked executor to exit and the chain failed, it runs the Compensate
+// functions for all completed inputs whose downstream processing didn't finish.
+func (it *itemTracker) stageExited(err stackerr.Error) stackerr.Error {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	if err != nil {
+		it.failed = true
+	}
+	it.numStagesRunning--
+	if it.numStagesRunning > 0 || !it.failed {
+		return err
+	}
+
+	// Find all records that have a root that didn't make it to the end of the chain
+	toCompensate := []*compensationRecord{}
+	for record := range it.records {
+		for _, root := range record.lineage {
+			if _, ok := it.refs[root]; ok {
+				toCompensate = append(toCompensate, record)
+				break
+			}
+		}
+	}
+	it.records = map[*compensationRecord]struct{}{}
+	it.recordsByRoot = map[uint64][]*compensationRecord{}
+
+	// Undo the work in reverse order, starting with the furthest downstream executor
+	sort.Slice(toCompensate, func(i, j int) bool {
+		if toCompensate[i].stage != toCompensate[j].stage {
+			return toCompensate[i].stage > toCompensate[j].stage
+		}
+		return toCompensate[i].seq > toCompensate[j].seq
+	})
+	compensationErrs := []stackerr.Error{}
+	for _, record := range toCompensate {
+		if cerr := record.compensate(it.ctx); cerr != nil {
+			compensationErrs = append(compensationErrs, cerr)
+		}
+	}
+	if len(compensationErrs) > 0 {
+		if err == nil {
+			err = stackerr.Errorf("an upstream executor failed")
+		}
+		return stackerr.Wrap(&CompensationError{
+			Err:              err,
+			CompensationErrs: compensationErrs,
+		})
+	}
+	return err
+}
+
+// mergeLineages returns the sorted union of the given lineages.
+func mergeLineages(lineages [][]uint64) []uint64 {
+	seen := map[uint64]struct{}{}
+	merged := []uint64{}
+	for _, lineage := range lineages {
+		for _, root := range lineage {
+			if _, ok := seen[root]; !ok {
+				seen[root] = struct{}{}
+				merged = append(merged, root)
+			}
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i] < merged[j]
+	})
+	return merged
+}
+
+// A tracked edge pairs the items in an executor's output channel with their lineages.
+// Sends into the channel and receives from it are each serialized, so that the Nth
+// lineage in the queue always belongs to the Nth item in the channel. Until a
+// downstream executor is chained to the channel, the items that are sent into it
+// have left the chain, so only the number of them is kept.
+type trackedEdge struct {
+	tracker *itemTracker
+	// A token that must be held to send into the output channel
+	sendToken chan struct{}
+	// A token that must be held to receive from the output channel
+	recvToken chan struct{}
+	lock      sync.Mutex
+	// The lineages of the items in the channel, in order
+	lineages [][]uint64
+	// Whether a downstream executor takes the items out of the channel
+	hasDownstream bool
+	// The number of items at the front of the channel that were sent before
+	// there was a downstream executor, and so have no lineage
+	untracked int
+	// Whether the last item that was pushed has no lineage
+	lastPushUntracked bool
+}
+
+func newTrackedEdge(tracker *itemTracker) *trackedEdge {
+	te := &trackedEdge{
+		tracker:   tracker,
+		sendToken: make(chan struct{}, 1),
+		recvToken: make(chan struct{}, 1),
+	}
+	te.sendToken <- struct{}{}
+	te.recvToken <- struct{}{}
+	return te
+}
+
+// setDownstream is called when a downstream executor is chained to the channel,
+// before it starts taking items out of it.
+func (te *trackedEdge) setDownstream() {
+	te.lock.Lock()
+	defer te.lock.Unlock()
+	te.hasDownstream = true
+}
+
+// push adds the lineage for an item that is about to be sent. Must be called
+// while holding the send token.
+func (te *trackedEdge) push(lineage []uint64) {
+	te.lock.Lock()
+	te.lastPushUntracked = !te.hasDownstream
+	if te.lastPushUntracked {
+		// The item leaves the chain, so there's nothing left to track
+		te.untracked++
+		te.lock.Unlock()
+		return
+	}
+	te.lineages = append(te.lineages, lineage)
+	te.lock.Unlock()
+	// The item in the channel holds a reference to its roots
+	te.tracker.hold(lineage)
+}
+
+// unpush removes the lineage for an item that could not be sent. Must be called
+// while holding the send token.
+func (te *trackedEdge) unpush() {
+	te.lock.Lock()
+	if te.lastPushUntracked {
+		te.untracked--
+		te.lock.Unlock()
+		return
+	}
+	lineage := te.lineages[len(te.lineages)-1]
+	te.lineages = te.lineages[:len(te.lineages)-1]
+	te.lock.Unlock()
+	te.tracker.release(lineage)
+}
+
+// pop removes the lineage for an item that was just received. Must be called
+// while holding the receive token.
+func (te *trackedEdge) pop() []uint64 {
+	te.lock.Lock()
+	if te.untracked > 0 {
+		// The item was sent before there was a downstream executor
+		te.untracked--
+		te.lock.Unlock()
+		return nil
+	}
+	lineage := te.lineages[0]
+	te.lineages[0] = nil
+	te.lineages = te.lineages[1:]
+	te.lock.Unlock()
+	// The reference that the item held in the channel is kept, since it's now being processed
+	return lineage
+}
+
+func (te *trackedEdge) releaseSend() {
+	te.sendToken <- struct{}{}
+}
+
+func (te *trackedEdge) releaseRecv() {
+	te.recvToken <- struct{}{}
+}
+
+// Tracks the lineages of the items that are being held in a batch.
+type batchLineages struct {
+	lineages [][]uint64
+}
+
+// add holds the lineage of an item that was added to the batch.
+func (bl *batchLineages) add(edge *trackedEdge, lineage []uint64) {
+	if edge == nil {
+		return
+	}
+	edge.tracker.hold(lineage)
+	bl.lineages = append(bl.lineages, lineage)
+}
+
+// send sends the batch with the combined lineage of all items in it, then releases
+// the lineages that the batch was holding.
+func (bl *batchLineages) send(edge *trackedEdge, item *trackedItem, sendFunc func() stackerr.Error) stackerr.Error {
+	if edge == nil {
+		return sendFunc()
+	}
+	held := bl.lineages
+	bl.lineages = nil
+	itemLineage := item.lineage
+	item.lineage = mergeLineages(held)
+	err := sendFunc()
+	item.lineage = itemLineage
+	if err == nil {
+		for _, lineage := range held {
+			edge.tracker.release(lineage)
+		}
+	}
+	return err
+}
@@ -1,6 +1,10 @@
 package concurrency
 
-import "context"
+import (
+	"context"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
 
 // This is a context that allows accessing the values of the inner
 // (wrapped) context, but does not get cancelled if the inner context
@@ -10,8 +14,8 @@ type executorContext struct {
 	WrappedCtx context.Context
 }
 
-func newExecutorContext(ctx context.Context) (context.Context, context.CancelFunc) {
-	newCtx, newCtxCancel := context.WithCancel(context.Background())
+func newExecutorContext(ctx context.Context) (context.Context, context.CancelCauseFunc) {
+	newCtx, newCtxCancel := context.WithCancelCause(context.Background())
 	return &executorContext{
 		Context:    newCtx,
 		WrappedCtx: ctx,
@@ -19,5 +23,54 @@ func newExecutorContext(ctx context.Context) (context.Context, context.CancelFun
 }
 
 func (uc *executorContext) Value(key any) any {
+	// Check our own context first, so that the cancellation (and its cause) of
+	// this context is found instead of the one of the wrapped context.
+	if v := uc.Context.Value(key); v != nil {
+		return v
+	}
 	return uc.WrappedCtx.Value(key)
 }
+
+// The error that is returned when a context was cancelled with a cause. It
+// matches the context error with errors.Is, and unwraps to the cause.
+type canceledError struct {
+	err   error
+	cause error
+}
+
+func (ce *canceledError) Error() string {
+	return ce.err.Error() + ": " + ce.cause.Error()
+}
+
+func (ce *canceledError) Is(target error) bool {
+	return target == ce.err
+}
+
+func (ce *canceledError) Unwrap() error {
+	return ce.cause
+}
+
+// contextError returns the error of a context that is done, including the
+// cause of the cancellation if there is one. Returns nil if the context isn't done.
+func contextError(ctx context.Context) stackerr.Error {
+	err := ctx.Err()
+	if err == nil {
+		return nil
+	}
+	if cause := context.Cause(ctx); cause != nil && cause != err {
+		return stackerr.Wrap(&canceledError{
+			err:   err,
+			cause: cause,
+		})
+	}
+	return stackerr.Wrap(err)
+}
+
+// contextCause returns the cause of the cancellation of a context, or the
+// given fallback error if the context hasn't been cancelled.
+func contextCause(ctx context.Context, fallback error) error {
+	if cause := context.Cause(ctx); cause != nil {
+		return cause
+	}
+	return fallback
+}
@@ -3,6 +3,7 @@ package concurrency
 import (
 	"context"
 	"reflect"
+	"sync/atomic"
 	"time"
 
 	"github.com/Invicton-Labs/go-stackerr"
@@ -12,6 +13,16 @@ import (
 var (
 	DefaultEmptyInputChannelCallbackInterval time.Duration = 1 * time.Second
 	DefaultFullOutputChannelCallbackInterval time.Duration = 1 * time.Second
+	DefaultKeyedRateLimitIdleTimeout         time.Duration = 1 * time.Minute
+	DefaultKeyedRateLimitMaxDeferred         int           = 100
+	DefaultAutoScaleInterval                 time.Duration = 1 * time.Second
+	DefaultAutoScaleCooldown                 time.Duration = 5 * time.Second
+	DefaultWatchdogInterval                  time.Duration = 1 * time.Second
+	DefaultSupervisorWindow                  time.Duration = 1 * time.Minute
+	DefaultSupervisorInitialBackoff          time.Duration = 100 * time.Millisecond
+	DefaultSupervisorMaxBackoff              time.Duration = 30 * time.Second
+	DefaultMaxRequeues                       int           = 10
+	DefaultMaxExitedRoutines                 int           = 100
 )
 
 type ProcessingFuncWithInputWithOutput[InputType any, OutputType any] func(ctx context.Context, input InputType, metadata *RoutineFunctionMetadata) (output OutputType, err stackerr.Error)
@@ -33,6 +44,8 @@ type RoutineFunctionMetadata struct {
 	ExecutorInputIndex uint64
 	// The index of the input for this routine
 	RoutineInputIndex uint64
+	// The number of times the current input has been requeued
+	RequeueCount uint
 	// The status tracker for this executor
 	RoutineStatusTracker *RoutineStatusTracker
 	// The status trackers for all executors in this chain (by map)
@@ -41,6 +54,9 @@ type RoutineFunctionMetadata struct {
 	RoutineStatusTrackersSlice []*RoutineStatusTracker
 	// A logger that is sweetened with additional data about the executor/routine
 	//Log *zap.SugaredLogger
+
+	// Internal use only. The live state of the routine.
+	state *routineState
 }
 
 type executorInput[
@@ -82,6 +98,22 @@ type executorInput[
 	// kill the consumer if the upstream executor fails. Has no effect for the
 	// top-level executor in a chain.
 	ProcessUpstreamOutputsAfterUpstreamError bool
+	// OPTIONAL. With ProcessUpstreamOutputsAfterUpstreamError, the maximum amount of time
+	// to keep processing upstream outputs after the upstream executor fails. Once it has
+	// passed, the executor is cancelled with ErrUpstreamErrorDrainTimeout as the cause.
+	// If 0, there is no time limit.
+	UpstreamErrorDrainTimeout time.Duration
+	// OPTIONAL. With ProcessUpstreamOutputsAfterUpstreamError, the maximum number of upstream
+	// outputs to process after the upstream executor fails. Once it has been reached, the
+	// executor is cancelled with ErrUpstreamErrorDrainMaxItems as the cause. If 0, there is
+	// no limit. The outcome of the drain is reported in the executor callbacks.
+	UpstreamErrorDrainMaxItems int
+
+	// OPTIONAL. What an error from the processing function cancels. Default
+	// (CancellationPolicyCancelUpstream) is to cancel this executor, all downstream
+	// executors and all upstream executors. Use CancellationPolicyIsolate for
+	// optional branches that must not take down the executors they consume from.
+	CancellationPolicy CancellationPolicy
 
 	// OPTIONAL. How long to wait for an input before calling the empty input callback
 	// function, IF one has been provided. Defaults to the
@@ -124,6 +156,102 @@ type executorInput[
 	// and the context was cancelled.
 	ExecutorContextDoneCallback func(input *ExecutorContextDoneCallbackInput) stackerr.Error
 
+	// OPTIONAL. A function to call when the processing function panics. It receives
+	// the recovered value, the stack and the input that was being processed, and
+	// decides whether the panic fails the executor (the default behaviour without a
+	// handler), skips the input, or gets raised again.
+	PanicHandler func(input *PanicHandlerInput[InputType]) PanicAction
+
+	// OPTIONAL. A function to call with the input and the error when the processing
+	// function returns an error. If it returns a nil error, its output is stored as
+	// if the processing function had succeeded. If it returns an error, that error
+	// is used instead of the original one. Fallbacks are counted in the
+	// RoutineStatusTracker.
+	Fallback func(ctx context.Context, input InputType, err stackerr.Error, metadata *RoutineFunctionMetadata) (output OutputType, fallbackErr stackerr.Error)
+
+	// OPTIONAL. How long a call of the processing function can go without sending a
+	// heartbeat (with Heartbeat on the metadata) before it fails with ErrHeartbeatTimeout.
+	// The context of the call is cancelled when that happens, so the processing function
+	// has to respect it to stop early. Default is no timeout.
+	HeartbeatTimeout time.Duration
+
+	// OPTIONAL. How many of the routines that have exited are kept in the snapshot from
+	// Routines on the RoutineStatusTracker, most recent first. If less than 0, none are
+	// kept. Defaults to the DefaultMaxExitedRoutines value.
+	MaxExitedRoutines int
+
+	// OPTIONAL. Watches the executor for stalls and reports what its routines are doing
+	// (including their stack traces) when it stalls. Default is no watchdog.
+	Watchdog Watchdog
+
+	// OPTIONAL. Restarts routines that fail, with a backoff, instead of failing the
+	// executor, until too many restarts happen within a period of time. Default is
+	// no restarts.
+	Supervisor Supervisor
+
+	// OPTIONAL. A limit on how often the routines can take an input, shared by all
+	// routines in the executor. Each routine waits for the limit before taking its
+	// next input. Can be changed while the executor is running with SetRateLimit.
+	// Default is no limit.
+	RateLimit RateLimit
+
+	// OPTIONAL. A separate limit for each key of the inputs, for stages that are
+	// shared by many tenants. An input whose key is over its limit is set aside
+	// until the key's limit allows it, and the routine takes another input instead.
+	// Once a key has too many inputs set aside, the routine waits for the key's limit
+	// instead, so that the input channel backs up.
+	KeyedRateLimit KeyedRateLimit[InputType]
+
+	// OPTIONAL. A fair scheduling mode, where inputs are queued by key and the routines
+	// take inputs from the keys in turn (weighted by the key's weight), instead of in the
+	// order they arrive in the input channel. The depth of each key's queue and the number
+	// of its inputs that have been taken are available from the RoutineStatusTracker.
+	FairQueue FairQueue[InputType]
+
+	// OPTIONAL. A limit on the number of processing function calls in flight at once,
+	// which adapts to the latency and errors of the calls, to protect fragile services
+	// that the calls depend on. The current limit is available from the
+	// RoutineStatusTracker. Default is no limit other than the number of routines.
+	AdaptiveLimit AdaptiveLimit
+
+	// OPTIONAL. Changes the number of routines while the executor is running, based on
+	// its load. Concurrency is the number of routines it starts with. Default is a fixed
+	// number of routines.
+	AutoScale AutoScale
+
+	// OPTIONAL. A limiter that caps the total cost of the processing function calls
+	// in flight across all executors that share it. Each call waits until its cost
+	// is available in the limiter. Default is no shared limit.
+	Limiter *Limiter
+	// OPTIONAL. A function that returns the cost of processing an input, taken from
+	// the Limiter for the duration of the call. Costs over the limiter's capacity
+	// are treated as its capacity. Defaults to a cost of 1 for every input.
+	LimiterCost func(input InputType) int64
+
+	// OPTIONAL. The maximum number of times an input can be requeued (by the processing
+	// function returning the error from Requeue) before it gets quarantined. Defaults
+	// to the DefaultMaxRequeues value. If less than 0, inputs can be requeued any number
+	// of times.
+	MaxRequeues int
+	// OPTIONAL. A function to call with an input that has been requeued more than
+	// MaxRequeues times. The input is dropped after this is called. If this isn't
+	// provided, exceeding MaxRequeues is treated as an error from the processing function.
+	QuarantineCallback func(input *QuarantineCallbackInput[InputType]) stackerr.Error
+
+	// OPTIONAL. A function that undoes the side effects of processing an input. If the
+	// chain fails, it gets called (after all executors in the chain have exited) for every
+	// input this executor completed whose downstream processing did not finish. Calls are
+	// made in reverse order, starting with the furthest downstream executor. Providing it
+	// enables tracking of items through this and all downstream executors, which serializes
+	// sends into and receives from their output channels. Chains where no executor has
+	// a Compensate function aren't tracked. An item is done with once it's finished by a
+	// final executor or put into the output channel of the last executor in the chain, and
+	// nothing is kept for it after that. Inputs that end up in the same
+	// batch downstream are tracked as a group from then on, so they are compensated
+	// together if any of them didn't finish. If any calls return an error,
+	// the last executor in the chain returns a CompensationError.
+	Compensate func(ctx context.Context, input InputType) stackerr.Error
+
 	// OPTIONAL. The number of elements in each batch. Only used for executors that batch outputs.
 	BatchSize int
 
@@ -134,19 +262,26 @@ type executorInput[
 
 	// Internal use only. Output from the upstream executor.
 	upstream *ExecutorOutput[InputType]
+
+	// Internal use only. For result executors, a function that checks whether an input
+	// is an error result from upstream and, if so, converts it into an output result.
+	resultPassthrough func(input InputType) (output OutputChanType, passthrough bool)
+	// Internal use only. For result executors, a function that converts an error from
+	// the processing function into an output result.
+	resultError func(input InputType, err stackerr.Error, metadata *RoutineFunctionMetadata) OutputChanType
 }
 
 type upstreamCtxCancel struct {
 	upstream   *upstreamCtxCancel
-	cancelFunc context.CancelFunc
+	cancelFunc context.CancelCauseFunc
 }
 
-func (ucc *upstreamCtxCancel) cancel() {
+func (ucc *upstreamCtxCancel) cancel(cause error) {
 	// Cancel the context for this level
-	ucc.cancelFunc()
+	ucc.cancelFunc(cause)
 	// Recurse up to the top
 	if ucc.upstream != nil {
-		ucc.upstream.cancel()
+		ucc.upstream.cancel(cause)
 	}
 }
 
@@ -171,7 +306,7 @@ type ExecutorOutput[OutputChanType any] struct {
 	OutputChan <-chan OutputChanType
 
 	// Internal use only. A function to cancel the output (passthrough) context.
-	passthroughCtxCancel context.CancelFunc
+	passthroughCtxCancel context.CancelCauseFunc
 
 	// Internal use only. The error group that is used for the executor routines.
 	errorGroup *errgroup.Group
@@ -188,6 +323,25 @@ type ExecutorOutput[OutputChanType any] struct {
 	routineStatusTrackersMap map[string]*RoutineStatusTracker
 
 	upstreamCtxCancel *upstreamCtxCancel
+
+	// Internal use only. The tracker for items flowing through the chain, if
+	// any executor in the chain has a Compensate function.
+	itemTracker *itemTracker
+	// Internal use only. The edge that pairs the items in the output channel
+	// with their lineages, if items are being tracked.
+	trackedEdge *trackedEdge
+	// Internal use only. The rate limiter for taking inputs.
+	rateLimiter *tokenBucket
+	// Internal use only. The target number of routines.
+	scaler *routineScaler
+	// Internal use only. Whether the executor is paused.
+	pauser *pauser
+	// Internal use only. The pausers of all executors in the chain, up to this one.
+	chainPausers []*pauser
+	// Internal use only. The drainer of the chain.
+	drainer *drainer
+	// Internal use only. The number of executors chained to this one that haven't exited.
+	numConsumers int32
 }
 
 // Wait waits for an executor to finish. If the executor exited with an error,
@@ -198,10 +352,88 @@ func (eo *ExecutorOutput[OutputChanType]) Wait() stackerr.Error {
 	// do for the error group, in order to handle cleanup related
 	// tasks. However, it is expected that calling "Wait()" will
 	// also finish the context, so we must manually cancel it.
-	eo.passthroughCtxCancel()
+	eo.passthroughCtxCancel(nil)
 	return err
 }
 
+// Cancel stops the executor and all upstream executors in the chain, and through them
+// all downstream executors, as if one of the executor's routines had failed with the
+// given cause. The cause is returned (wrapped) by Wait, and is available from the
+// context returned by Ctx with context.Cause. If the cause is nil, context.Canceled
+// is used.
+func (eo *ExecutorOutput[OutputChanType]) Cancel(cause error) {
+	eo.upstreamCtxCancel.cancel(cause)
+}
+
+// SetRateLimit changes the rate limit of the executor while it's running. Routines
+// that are already waiting for the previous limit finish waiting for it. A Rate of
+// 0 or less removes the limit.
+func (eo *ExecutorOutput[OutputChanType]) SetRateLimit(limit RateLimit) {
+	eo.rateLimiter.setLimit(limit)
+}
+
+// SetConcurrency changes the number of routines of the executor while it's running.
+// If it's raised, new routines are started right away. If it's lowered, routines
+// retire the next time they're waiting for an input, so no input that's being
+// processed is interrupted. Has no effect if the executor has already finished.
+// Panics if the concurrency is less than 1.
+func (eo *ExecutorOutput[OutputChanType]) SetConcurrency(concurrency int) {
+	if concurrency < 1 {
+		panic("concurrency must not be less than 1")
+	}
+	eo.scaler.setTarget(concurrency)
+}
+
+// Concurrency returns the number of routines the executor is meant to be running. Right
+// after the concurrency has been lowered, more routines may still be running until they
+// retire.
+func (eo *ExecutorOutput[OutputChanType]) Concurrency() int {
+	return eo.scaler.getTarget()
+}
+
+// Pause stops the routines of the executor from taking inputs. Routines finish the
+// input they're processing (and output it), and then wait until Resume is called.
+// Contexts aren't cancelled, and nothing is lost. While paused, routines are counted
+// as Paused in the RoutineStatusTracker, and the EmptyInputChannelCallback isn't called.
+func (eo *ExecutorOutput[OutputChanType]) Pause() {
+	eo.pauser.setPaused(true)
+}
+
+// Resume lets the routines of a paused executor take inputs again.
+func (eo *ExecutorOutput[OutputChanType]) Resume() {
+	eo.pauser.setPaused(false)
+}
+
+// IsPaused returns whether the executor is paused.
+func (eo *ExecutorOutput[OutputChanType]) IsPaused() bool {
+	paused, _ := eo.pauser.isPaused()
+	return paused
+}
+
+// PauseChain pauses this executor and every executor upstream of it in the chain.
+func (eo *ExecutorOutput[OutputChanType]) PauseChain() {
+	for _, p := range eo.chainPausers {
+		p.setPaused(true)
+	}
+}
+
+// ResumeChain resumes this executor and every executor upstream of it in the chain.
+func (eo *ExecutorOutput[OutputChanType]) ResumeChain() {
+	for _, p := range eo.chainPausers {
+		p.setPaused(false)
+	}
+}
+
+// Drain stops the first executor of the chain from taking new inputs, and lets the
+// chain finish what it already has: inputs that were already taken (or requeued) are
+// processed, every downstream executor processes what's buffered in its input channel,
+// and final batches are flushed. The chain then finishes successfully, as if the input
+// channel of the first executor had been closed. This can be called on any executor
+// in the chain, including ones that don't own their input channel (like Continuous).
+func (eo *ExecutorOutput[OutputChanType]) Drain() {
+	eo.drainer.drain()
+}
+
 // Ctx returns a context that is derived from the top-level executor's input context and is cancelled
 // if any of the executors in a chain fail (after they are all cleaned up).
 func (eo *ExecutorOutput[OutputChanType]) Ctx() context.Context {
@@ -257,6 +489,15 @@ func new[
 	if input.Concurrency == 0 {
 		input.Concurrency = 1
 	}
+	if input.AutoScale.enabled() {
+		if input.AutoScale.MinConcurrency > input.AutoScale.MaxConcurrency {
+			panic("input.AutoScale.MinConcurrency cannot be greater than input.AutoScale.MaxConcurrency")
+		}
+		input.Concurrency = input.AutoScale.clamp(input.Concurrency)
+	}
+	if input.Watchdog.enabled() && input.Watchdog.Callback == nil && !input.Watchdog.FailChain {
+		panic("input.Watchdog must have a Callback or FailChain")
+	}
 
 	// This is a context that is used internally for the routines in this executor. It
 	// gets cancelled as soon as any of the routines in this executor returns an error or,
@@ -265,7 +506,7 @@ func new[
 
 	// By default, wrap the input context. This way, if the input context ever gets cancelled,
 	// it will also cancel all routines in this executor.
-	internalCtx, internalCtxCancel := context.WithCancel(ctx)
+	internalCtx, internalCtxCancel := context.WithCancelCause(ctx)
 	// If, however, we want to continue to process upstream outputs after an upstream failure
 	// (i.e. keep processing anything still remaining in the input channel), then use a version
 	// of the context that has access to the same values, but won't be cancelled if the upstream
@@ -300,11 +541,17 @@ func new[
 	var routineStatusTrackersSlice []*RoutineStatusTracker
 
 	// Create a new routine status tracker struct
+	now := time.Now().UnixNano()
 	routineStatusTracker := &RoutineStatusTracker{
 		executorName:       input.Name,
+		maxExitedRoutines:  zeroDefault(input.MaxExitedRoutines, DefaultMaxExitedRoutines),
 		numRoutinesRunning: int32(input.Concurrency),
+		lastProgress:       now,
+		lastInput:          now,
+		lastOutput:         now,
+		outputChanCapacity: cap(outputChan),
 		getInputChanLength: func() int {
-			return len(input.InputChannel)
+			return len(inputChan)
 		},
 		getOutputChanLength: func() *int {
 			if outputChan != nil {
@@ -331,6 +578,34 @@ func new[
 		routineStatusTrackersSlice = []*RoutineStatusTracker{routineStatusTracker}
 	}
 
+	// Each executor in a chain can be paused, and the whole chain can be paused
+	// from any executor in it.
+	var chainPausers []*pauser
+	if input.upstream != nil {
+		chainPausers = make([]*pauser, len(input.upstream.chainPausers), len(input.upstream.chainPausers)+1)
+		copy(chainPausers, input.upstream.chainPausers)
+	}
+	executorPauser := newPauser()
+	chainPausers = append(chainPausers, executorPauser)
+
+	// Draining the chain only stops the first executor in it from taking inputs,
+	// and the rest finish once their upstream executors have.
+	var chainDrainer *drainer
+	var drained <-chan struct{}
+	if input.upstream != nil {
+		chainDrainer = input.upstream.drainer
+	} else {
+		chainDrainer = newDrainer()
+		drained = chainDrainer.drained
+	}
+	routineStatusTracker.isDraining = func() bool {
+		return isClosed(chainDrainer.drained)
+	}
+	routineStatusTracker.isPaused = func() bool {
+		paused, _ := executorPauser.isPaused()
+		return paused
+	}
+
 	// Create an error group for the routines. We don't need to create a
 	// context because we manage the context separately.
 	errGroup := &errgroup.Group{}
@@ -350,22 +625,51 @@ func new[
 		ExecutorName: input.Name,
 	}
 
+	// Items get tracked through the chain starting at the first executor that has
+	// a Compensate function.
+	stage := len(routineStatusTrackersSlice) - 1
+	var tracker *itemTracker
+	var inputEdge, outputEdge *trackedEdge
+	createRoots := false
+	if input.upstream != nil && input.upstream.itemTracker != nil {
+		tracker = input.upstream.itemTracker
+		inputEdge = input.upstream.trackedEdge
+		inputEdge.setDownstream()
+	} else if input.Compensate != nil {
+		tracker = newItemTracker(ctx)
+		createRoots = true
+	}
+	if tracker != nil {
+		tracker.register()
+		if outputChan != nil {
+			outputEdge = newTrackedEdge(tracker)
+		}
+	}
+
+	if input.upstream != nil {
+		input.upstream.addConsumer()
+	}
+
 	upstreamCancellation := &upstreamCtxCancel{
 		cancelFunc: internalCtxCancel,
 	}
-	if input.upstream != nil {
+	// Isolated executors don't pass cancellations on to the executors upstream of them
+	if input.upstream != nil && input.CancellationPolicy != CancellationPolicyIsolate {
 		upstreamCancellation.upstream = input.upstream.upstreamCtxCancel
 	}
 
 	routineExitSettings := &routineExitSettings[InputType, OutputType, OutputChanType, ProcessingFuncType]{
 		executorInput:        &input,
+		internalCtx:          internalCtx,
 		upstreamCtxCancel:    upstreamCancellation,
 		passthroughCtxCancel: passthroughCtxCancel,
 		// Create a channel that will be closed ONLY if this executor exits with an error.
 		errChan:                   make(chan struct{}),
+		finished:                  make(chan struct{}),
 		routineStatusTracker:      routineStatusTracker,
 		outputChan:                outputChan,
 		baseExecutorCallbackInput: baseCallbackInput,
+		itemTracker:               tracker,
 	}
 
 	var isBatchOutput bool
@@ -379,6 +683,51 @@ func new[
 
 	batchTimeTracker := newTimeTracker(input.BatchMaxPeriod, true)
 
+	// In fair queuing mode, a dispatcher takes the inputs from the input channel
+	// and gives them to the routines in a fair order.
+	var fairQueue *fairQueue[InputType]
+	if inputChan != nil {
+		fairQueue = newFairQueue(input.FairQueue, zeroDefault(input.FairQueue.MaxQueued, 2*input.Concurrency))
+	}
+	if fairQueue != nil {
+		routineStatusTracker.getFairQueueStats = fairQueue.stats
+		go fairQueue.run(internalCtx, inputChan, inputEdge, tracker, createRoots, executorPauser, drained)
+	}
+
+	rateLimiter := newTokenBucket(input.RateLimit)
+
+	// Requeued inputs go behind the inputs that are waiting in the input
+	// channel, or in the fair queue.
+	requeueQueue := newRequeueQueue[InputType](func() int {
+		backlog := len(inputChan)
+		if fairQueue != nil {
+			backlog += fairQueue.queued()
+		}
+		return backlog
+	})
+	routineExitSettings.requeueQueue = requeueQueue
+
+	// Track the processing of upstream outputs after the upstream executor fails, so
+	// that it can be limited and reported.
+	var upstreamErrorDrain *upstreamErrorDrain
+	if input.upstream != nil && input.ProcessUpstreamOutputsAfterUpstreamError {
+		upstreamErrorDrain = newUpstreamErrorDrain(input.UpstreamErrorDrainTimeout, input.UpstreamErrorDrainMaxItems, internalCtxCancel)
+		routineExitSettings.upstreamErrorDrain = upstreamErrorDrain
+		go upstreamErrorDrain.watch(input.upstream.Errored(), routineExitSettings.finished)
+	}
+	scaler := newRoutineScaler(input.Concurrency)
+	adaptiveLimiter := newAdaptiveLimiter(input.AdaptiveLimit)
+	if adaptiveLimiter != nil {
+		routineStatusTracker.getAdaptiveLimit = adaptiveLimiter.getLimit
+	}
+
+	// The routines of an executor with a watchdog are labelled with a unique
+	// ID, so that the watchdog can find their stacks.
+	var watchdogExecutorID uint64
+	if input.Watchdog.enabled() {
+		watchdogExecutorID = atomic.AddUint64(&lastWatchdogExecutorID, 1)
+	}
+
 	routineSettings := &routineSettings[InputType, OutputType, OutputChanType, ProcessingFuncType]{
 		executorInput:                     &input,
 		internalCtx:                       internalCtx,
@@ -388,6 +737,22 @@ func new[
 		routineStatusTrackersSlice:        routineStatusTrackersSlice,
 		routineStatusTrackersMap:          routineStatusTrackersMap,
 		inputIndexCounter:                 &inputIndex,
+		requeueQueue:                      requeueQueue,
+		rateLimiter:                       rateLimiter,
+		keyedRateLimiter:                  newKeyedRateLimiter(input.KeyedRateLimit),
+		fairQueue:                         fairQueue,
+		scaler:                            scaler,
+		adaptiveLimiter:                   adaptiveLimiter,
+		supervisor:                        newSupervisor(input.Supervisor),
+		watchdogExecutorID:                watchdogExecutorID,
+		pauser:                            executorPauser,
+		upstreamErrorDrain:                upstreamErrorDrain,
+		drained:                           drained,
+		itemTracker:                       tracker,
+		inputEdge:                         inputEdge,
+		outputEdge:                        outputEdge,
+		createRoots:                       createRoots,
+		stage:                             stage,
 		outputIndexCounter:                &outputIndex,
 		emptyInputChannelCallbackInterval: zeroDefault(input.EmptyInputChannelCallbackInterval, DefaultEmptyInputChannelCallbackInterval),
 		fullOutputChannelCallbackInterval: zeroDefault(input.FullOutputChannelCallbackInterval, DefaultFullOutputChannelCallbackInterval),
@@ -440,6 +805,19 @@ func new[
 		panic("Unrecognized processing function signature")
 	}
 
+	// Routines that get added by SetConcurrency are counted as running before
+	// they start, so that the executor can't finish in between.
+	scaler.start = func(routineIdx uint) bool {
+		if !routineStatusTracker.addRoutine() {
+			return false
+		}
+		errGroup.Go(getRoutine(
+			routineSettings,
+			routineIdx,
+		))
+		return true
+	}
+
 	// Start the same number of routines as the concurrency
 	for i := 0; i < input.Concurrency; i++ {
 		errGroup.Go(getRoutine(
@@ -448,6 +826,14 @@ func new[
 		))
 	}
 
+	if input.Watchdog.enabled() {
+		go runWatchdog(internalCtx, routineExitSettings.finished, input.Watchdog, watchdogExecutorID, routineStatusTracker, baseCallbackInput.clone(), routineExitSettings.fail)
+	}
+
+	if input.AutoScale.enabled() {
+		go runAutoScaler(internalCtx, routineExitSettings.finished, input.AutoScale, scaler, routineStatusTracker, baseCallbackInput.clone(), routineExitSettings.fail)
+	}
+
 	return &ExecutorOutput[OutputChanType]{
 		ctx:                        passthroughCtx,
 		errChan:                    routineExitSettings.errChan,
@@ -459,5 +845,12 @@ func new[
 		errorGroup:                 errGroup,
 		passthroughCtxCancel:       passthroughCtxCancel,
 		upstreamCtxCancel:          upstreamCancellation,
+		itemTracker:                tracker,
+		trackedEdge:                outputEdge,
+		rateLimiter:                rateLimiter,
+		scaler:                     scaler,
+		pauser:                     executorPauser,
+		chainPausers:               chainPausers,
+		drainer:                    chainDrainer,
 	}
 }
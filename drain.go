@@ -0,0 +1,35 @@
+package concurrency
+
+import "sync"
+
+// drainer stops the first executor of a chain from taking new inputs, so that
+// the chain can finish the inputs it already has and then exit successfully. It's
+// shared by all executors in the chain, so the chain can be drained from any of them.
+type drainer struct {
+	once sync.Once
+	// Gets closed when the chain is drained
+	drained chan struct{}
+}
+
+func newDrainer() *drainer {
+	return &drainer{
+		drained: make(chan struct{}),
+	}
+}
+
+func (d *drainer) drain() {
+	d.once.Do(func() {
+		close(d.drained)
+	})
+}
+
+// isClosed returns whether a channel that is only ever closed (never sent to)
+// has been closed. Returns false for a nil channel.
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
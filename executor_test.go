@@ -3,7 +3,12 @@ package concurrency
 import (
 	"context"
 	"errors"
+	"fmt"
 	"math"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -85,6 +90,41 @@ func TestExecutorPerformance(t *testing.T) {
 	testVerifyCleanup(t, executor)
 }
 
+// BenchmarkExecutor measures the overhead per input of an executor with a
+// single routine and a processing function that does nothing, which is the
+// cost that every input pays when no option is used.
+func BenchmarkExecutor(b *testing.B) {
+	benchmarks := map[string]ExecutorInput[int, int]{
+		"default": {},
+		"callbacks": {
+			EmptyInputChannelCallback: testEmptyInputCallback,
+			FullOutputChannelCallback: testFullOutputCallback,
+		},
+	}
+	for name, input := range benchmarks {
+		b.Run(name, func(b *testing.B) {
+			inputChan := make(chan int, b.N)
+			for i := 0; i < b.N; i++ {
+				inputChan <- i
+			}
+			close(inputChan)
+			input.Name = "benchmark-executor-" + name
+			input.Concurrency = 1
+			input.OutputChannelSize = b.N
+			input.InputChannel = inputChan
+			input.Func = func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+				return input, nil
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			executor := Executor(context.Background(), input)
+			if err := executor.Wait(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
 func TestExecutor(t *testing.T) {
 	testMultiConcurrenciesMultiInput(t, "executor", testExecutor)
 }
@@ -376,3 +416,1324 @@ func testExecutorError(t *testing.T, numRoutines int, inputCount int) {
 	}
 	testVerifyCleanup(t, executor)
 }
+
+func TestExecutorPanicHandler(t *testing.T) {
+	testMultiConcurrencies(t, "executor-panic-handler", testExecutorPanicHandler)
+}
+func testExecutorPanicHandler(t *testing.T, numRoutines int) {
+	ctx := context.Background()
+	inputCount := 1000
+	var skipped int32 = 0
+	executor := Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-panic-handler-1",
+		Concurrency:       numRoutines,
+		OutputChannelSize: inputCount,
+		InputChannel:      RangeToChan(0, inputCount),
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			if input%2 == 1 {
+				panic("test-panic")
+			}
+			return input, nil
+		},
+		PanicHandler: func(input *PanicHandlerInput[int]) PanicAction {
+			if input.Input%2 != 1 || input.Recovered != "test-panic" || len(input.Stack) == 0 {
+				t.Errorf("Unexpected panic handler input for value %d: %v", input.Input, input.Recovered)
+			}
+			atomic.AddInt32(&skipped, 1)
+			return PanicActionSkip
+		},
+	})
+	if err := executor.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if int(skipped) != inputCount/2 {
+		t.Fatalf("Skipped %d inputs, but expected %d", skipped, inputCount/2)
+	}
+	numOutput := 0
+	for v := range executor.OutputChan {
+		if v%2 == 1 {
+			t.Fatalf("Received output %d for an input that panicked", v)
+		}
+		numOutput++
+	}
+	if numOutput != inputCount/2 {
+		t.Fatalf("Received %d outputs, but expected %d", numOutput, inputCount/2)
+	}
+	testVerifyCleanup(t, executor)
+
+	executor = Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-panic-handler-2",
+		Concurrency:       numRoutines,
+		OutputChannelSize: inputCount,
+		InputChannel:      RangeToChan(0, inputCount),
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			if input == inputCount/2 {
+				panic("test-panic")
+			}
+			return input, nil
+		},
+		PanicHandler: func(input *PanicHandlerInput[int]) PanicAction {
+			return PanicActionFail
+		},
+	})
+	if err := executor.Wait(); err == nil {
+		t.Fatalf("Expected an error, received none")
+	}
+	testVerifyCleanup(t, executor)
+}
+
+//go:noinline
+func testRepanicSource() {
+	panic("test-repanic")
+}
+
+func TestExecutorPanicHandlerRepanic(t *testing.T) {
+	// A panic that's raised again crashes the program, so it has to happen in a subprocess
+	if os.Getenv("TEST_EXECUTOR_REPANIC") == "1" {
+		executor := Executor(context.Background(), ExecutorInput[int, int]{
+			Name:         "test-executor-panic-handler-repanic",
+			InputChannel: RangeToChan(0, 1),
+			Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+				testRepanicSource()
+				return input, nil
+			},
+			PanicHandler: func(input *PanicHandlerInput[int]) PanicAction {
+				return PanicActionRepanic
+			},
+		})
+		executor.Wait()
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExecutorPanicHandlerRepanic$")
+	cmd.Env = append(os.Environ(), "TEST_EXECUTOR_REPANIC=1")
+	output, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("Expected the subprocess to crash, but received %v", err)
+	}
+	// The value that the panic was raised again with has the recovered value
+	// and the stack of the original panic
+	message, stack, found := strings.Cut(string(output), "original panic stack:")
+	if !found || !strings.Contains(message, "panic: test-repanic") || !strings.Contains(stack, "testRepanicSource") {
+		t.Fatalf("Expected the original panic and its stack in the output, but received:\n%s", output)
+	}
+}
+
+func TestExecutorFallback(t *testing.T) {
+	testMultiConcurrencies(t, "executor-fallback", testExecutorFallback)
+}
+func testExecutorFallback(t *testing.T, numRoutines int) {
+	ctx := context.Background()
+	inputCount := 1000
+	executor := Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-fallback-1",
+		Concurrency:       numRoutines,
+		OutputChannelSize: inputCount,
+		InputChannel:      RangeToChan(0, inputCount),
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			if input%2 == 1 {
+				return 0, stackerr.Errorf("test-error")
+			}
+			return input, nil
+		},
+		Fallback: func(ctx context.Context, input int, err stackerr.Error, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			if err.Error() != "test-error" {
+				t.Errorf("Received unexpected error string: %s", err.Error())
+			}
+			return -input, nil
+		},
+	})
+	if err := executor.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if int(executor.RoutineStatusTracker.GetNumFallbacks()) != inputCount/2 {
+		t.Fatalf("Counted %d fallbacks, but expected %d", executor.RoutineStatusTracker.GetNumFallbacks(), inputCount/2)
+	}
+	numFallbackOutputs := 0
+	for v := range executor.OutputChan {
+		if v < 0 {
+			numFallbackOutputs++
+		}
+	}
+	if numFallbackOutputs != inputCount/2 {
+		t.Fatalf("Received %d fallback outputs, but expected %d", numFallbackOutputs, inputCount/2)
+	}
+	testVerifyCleanup(t, executor)
+}
+
+func TestExecutorCancellationPolicyIgnore(t *testing.T) {
+	testMultiConcurrencies(t, "executor-cancellation-policy-ignore", testExecutorCancellationPolicyIgnore)
+}
+func testExecutorCancellationPolicyIgnore(t *testing.T, numRoutines int) {
+	ctx := context.Background()
+	inputCount := 1000
+	executor := Executor(ctx, ExecutorInput[int, int]{
+		Name:               "test-executor-cancellation-policy-ignore-1",
+		Concurrency:        numRoutines,
+		OutputChannelSize:  inputCount,
+		InputChannel:       RangeToChan(0, inputCount),
+		CancellationPolicy: CancellationPolicyIgnore,
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			if input%2 == 1 {
+				return 0, stackerr.Errorf("test-error")
+			}
+			return input, nil
+		},
+	})
+	if err := executor.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if int(executor.RoutineStatusTracker.GetNumIgnoredErrors()) != inputCount/2 {
+		t.Fatalf("Counted %d ignored errors, but expected %d", executor.RoutineStatusTracker.GetNumIgnoredErrors(), inputCount/2)
+	}
+	numOutputs := 0
+	for v := range executor.OutputChan {
+		if v%2 == 1 {
+			t.Fatalf("Received output %d for an input that failed", v)
+		}
+		numOutputs++
+	}
+	if numOutputs != inputCount/2 {
+		t.Fatalf("Received %d outputs, but expected %d", numOutputs, inputCount/2)
+	}
+	testVerifyCleanup(t, executor)
+}
+
+func TestExecutorRateLimit(t *testing.T) {
+	testMultiConcurrencies(t, "executor-rate-limit", testExecutorRateLimit)
+}
+func testExecutorRateLimit(t *testing.T, numRoutines int) {
+	ctx := context.Background()
+	inputCount := 100
+	limit := RateLimit{
+		Rate:  200,
+		Burst: 10,
+	}
+	start := time.Now()
+	executor := Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-rate-limit-1",
+		Concurrency:       numRoutines,
+		OutputChannelSize: inputCount,
+		InputChannel:      RangeToChan(0, inputCount),
+		RateLimit:         limit,
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			return input, nil
+		},
+	})
+	if err := executor.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	minimum := time.Duration(float64(inputCount-limit.Burst) / limit.Rate * float64(time.Second))
+	if elapsed < minimum*9/10 {
+		t.Fatalf("Processed %d inputs in %s, but expected it to take at least %s", inputCount, elapsed, minimum)
+	}
+	testVerifyCleanup(t, executor)
+
+	// Change the rate limit while the executor is running
+	executor = Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-rate-limit-2",
+		Concurrency:       numRoutines,
+		OutputChannelSize: inputCount,
+		InputChannel:      RangeToChan(0, inputCount),
+		RateLimit: RateLimit{
+			Rate:  1,
+			Burst: 1,
+		},
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			return input, nil
+		},
+	})
+	// At this rate, it would take over a minute to finish, so the routines
+	// stay rate limited until the limit is raised
+	deadline := time.Now().Add(5 * time.Second)
+	for executor.RoutineStatusTracker.GetNumRoutinesRateLimited() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected routines to be counted as rate limited")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	executor.SetRateLimit(RateLimit{
+		Rate:  10000,
+		Burst: 10,
+	})
+	start = time.Now()
+	if err := executor.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// Routines that were already waiting for the old limit finish waiting for it
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Processed %d inputs in %s after raising the rate limit", inputCount, elapsed)
+	}
+	testVerifyCleanup(t, executor)
+}
+
+func TestExecutorKeyedRateLimit(t *testing.T) {
+	testMultiConcurrencies(t, "executor-keyed-rate-limit", testExecutorKeyedRateLimit)
+}
+func testExecutorKeyedRateLimit(t *testing.T, numRoutines int) {
+	ctx := context.Background()
+	// One busy tenant, whose inputs all come first, and a few small ones
+	busyCount := 20
+	inputs := []string{}
+	for i := 0; i < busyCount; i++ {
+		inputs = append(inputs, "busy")
+	}
+	for _, tenant := range []string{"a", "b", "c", "d"} {
+		for i := 0; i < 3; i++ {
+			inputs = append(inputs, tenant)
+		}
+	}
+	limit := RateLimit{
+		Rate:  20,
+		Burst: 1,
+	}
+	var lock sync.Mutex
+	lastProcessed := map[string]time.Time{}
+	start := time.Now()
+	executor := Executor(ctx, ExecutorInput[string, string]{
+		Name:              "test-executor-keyed-rate-limit-1",
+		Concurrency:       numRoutines,
+		OutputChannelSize: len(inputs),
+		InputChannel:      SliceToChan(inputs),
+		KeyedRateLimit: KeyedRateLimit[string]{
+			Key: func(input string) string {
+				return input
+			},
+			Limit: limit,
+		},
+		Func: func(ctx context.Context, input string, metadata *RoutineFunctionMetadata) (string, stackerr.Error) {
+			lock.Lock()
+			lastProcessed[input] = time.Now()
+			lock.Unlock()
+			return input, nil
+		},
+	})
+	if err := executor.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if len(executor.OutputChan) != len(inputs) {
+		t.Fatalf("Received %d outputs, but expected %d", len(executor.OutputChan), len(inputs))
+	}
+	busyMinimum := time.Duration(float64(busyCount-limit.Burst) / limit.Rate * float64(time.Second))
+	if elapsed := lastProcessed["busy"].Sub(start); elapsed < busyMinimum*9/10 {
+		t.Fatalf("Processed the busy tenant's inputs in %s, but expected it to take at least %s", elapsed, busyMinimum)
+	}
+	// The small tenants shouldn't have had to wait for the busy one
+	for _, tenant := range []string{"a", "b", "c", "d"} {
+		if elapsed := lastProcessed[tenant].Sub(start); elapsed > busyMinimum/2 {
+			t.Fatalf("Processed the inputs of tenant %s in %s, which is too long", tenant, elapsed)
+		}
+	}
+	testVerifyCleanup(t, executor)
+
+	// Idle keys are forgotten once their limit has recovered
+	limiter := newKeyedRateLimiter(KeyedRateLimit[string]{
+		Key: func(input string) string {
+			return input
+		},
+		Limit:       limit,
+		IdleTimeout: 10 * time.Millisecond,
+	})
+	limiter.reserve("a")
+	limiter.reserve("b")
+	time.Sleep(100 * time.Millisecond)
+	limiter.reserve("c")
+	if limiter.numKeys() != 1 {
+		t.Fatalf("Tracking %d keys, but expected the idle keys to be forgotten", limiter.numKeys())
+	}
+}
+
+func TestExecutorKeyedRateLimitBackpressure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inputChan := make(chan string, 5)
+	maxDeferred := 2
+	executor := Executor(ctx, ExecutorInput[string, string]{
+		Name:              "test-executor-keyed-rate-limit-backpressure-1",
+		Concurrency:       1,
+		OutputChannelSize: 100,
+		InputChannel:      inputChan,
+		KeyedRateLimit: KeyedRateLimit[string]{
+			Key: func(input string) string {
+				return input
+			},
+			Limit: RateLimit{
+				Rate:  0.1,
+				Burst: 1,
+			},
+			MaxDeferred: maxDeferred,
+		},
+		Func: func(ctx context.Context, input string, metadata *RoutineFunctionMetadata) (string, stackerr.Error) {
+			return input, nil
+		},
+	})
+	// Keep the input channel topped up with inputs of a single key
+	var sent int64
+	go func() {
+		for {
+			select {
+			case inputChan <- "busy":
+				atomic.AddInt64(&sent, 1)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	time.Sleep(500 * time.Millisecond)
+	if len(inputChan) != cap(inputChan) {
+		t.Fatalf("The input channel has %d inputs, but expected it to stay full", len(inputChan))
+	}
+	// One input was processed with the burst, some were set aside, and the
+	// routine is waiting on the last one it took. The rest stay in the channel.
+	if taken := atomic.LoadInt64(&sent) - int64(len(inputChan)); taken > int64(1+maxDeferred+1) {
+		t.Fatalf("Took %d inputs from the input channel, but expected at most %d", taken, 1+maxDeferred+1)
+	}
+	if len(executor.OutputChan) != 1 {
+		t.Fatalf("Received %d outputs, but expected 1", len(executor.OutputChan))
+	}
+	cancel()
+	executor.Wait()
+}
+
+func TestExecutorFairQueue(t *testing.T) {
+	// A single routine is used so that the order of processing can be checked
+	for _, bigWeight := range []int{1, 3} {
+		ctx := context.Background()
+		bigCount, smallCount := 100, 10
+		inputs := []string{}
+		for i := 0; i < bigCount; i++ {
+			inputs = append(inputs, "big")
+		}
+		for i := 0; i < smallCount; i++ {
+			inputs = append(inputs, "small")
+		}
+		ready := make(chan struct{})
+		processed := []string{}
+		executor := Executor(ctx, ExecutorInput[string, string]{
+			Name:              "test-executor-fair-queue-1",
+			Concurrency:       1,
+			OutputChannelSize: len(inputs),
+			InputChannel:      SliceToChan(inputs),
+			FairQueue: FairQueue[string]{
+				Key: func(input string) string {
+					return input
+				},
+				Weight: func(key string) int {
+					if key == "big" {
+						return bigWeight
+					}
+					return 1
+				},
+				MaxQueued: len(inputs),
+			},
+			Func: func(ctx context.Context, input string, metadata *RoutineFunctionMetadata) (string, stackerr.Error) {
+				// Wait for everything else to be queued before processing the first input
+				if len(processed) == 0 {
+					<-ready
+				}
+				processed = append(processed, input)
+				return input, nil
+			},
+		})
+		for {
+			depths := executor.RoutineStatusTracker.GetFairQueueDepths()
+			if depths["big"]+depths["small"] == len(inputs)-1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		close(ready)
+		if err := executor.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		if len(processed) != len(inputs) {
+			t.Fatalf("Processed %d inputs, but expected %d", len(processed), len(inputs))
+		}
+		// Each small input should have been processed after at most bigWeight big ones
+		lastSmall := 0
+		for i, input := range processed {
+			if input == "small" {
+				lastSmall = i
+			}
+		}
+		if maximum := 1 + smallCount*(bigWeight+1); lastSmall >= maximum {
+			t.Fatalf("The last small input was processed at position %d, but expected it before position %d", lastSmall, maximum)
+		}
+		served := executor.RoutineStatusTracker.GetFairQueueServed()
+		if int(served["big"]) != bigCount || int(served["small"]) != smallCount {
+			t.Fatalf("Served %d big and %d small inputs, but expected %d and %d", served["big"], served["small"], bigCount, smallCount)
+		}
+		testVerifyCleanup(t, executor)
+	}
+}
+
+func TestExecutorLimiter(t *testing.T) {
+	testMultiConcurrencies(t, "executor-limiter", testExecutorLimiter)
+}
+func testExecutorLimiter(t *testing.T, numRoutines int) {
+	ctx := context.Background()
+	inputCount := 100
+	limiter := NewLimiter(5)
+	// The total cost of the calls in flight across both executors
+	var inFlight int64 = 0
+	var peak int64 = 0
+	cost := func(input int) int64 {
+		return int64(input%2) + 1
+	}
+	process := func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+		current := atomic.AddInt64(&inFlight, cost(input))
+		for {
+			prev := atomic.LoadInt64(&peak)
+			if current <= prev || atomic.CompareAndSwapInt64(&peak, prev, current) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt64(&inFlight, -cost(input))
+		return input, nil
+	}
+	executors := []*ExecutorOutput[int]{}
+	for i := 0; i < 2; i++ {
+		executors = append(executors, Executor(ctx, ExecutorInput[int, int]{
+			Name:              fmt.Sprintf("test-executor-limiter-%d", i),
+			Concurrency:       numRoutines,
+			OutputChannelSize: inputCount,
+			InputChannel:      RangeToChan(0, inputCount),
+			Limiter:           limiter,
+			LimiterCost:       cost,
+			Func:              process,
+		}))
+	}
+	for _, executor := range executors {
+		if err := executor.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p := atomic.LoadInt64(&peak); p > limiter.GetCapacity() {
+		t.Fatalf("Peak in-flight cost was %d, but the limiter's capacity is %d", p, limiter.GetCapacity())
+	}
+	if limiter.GetInFlight() != 0 {
+		t.Fatalf("Expected nothing to be in flight, but the limiter has %d", limiter.GetInFlight())
+	}
+	if limiter.GetNumAcquired() != uint64(2*inputCount) {
+		t.Fatalf("Expected %d calls to take from the limiter, but got %d", 2*inputCount, limiter.GetNumAcquired())
+	}
+	if numRoutines > 1 && (limiter.GetNumWaited() == 0 || limiter.GetTotalWaitTime() == 0) {
+		t.Fatalf("Expected calls to wait for the limiter")
+	}
+	for _, executor := range executors {
+		testVerifyCleanup(t, executor)
+	}
+}
+
+func TestExecutorSetConcurrency(t *testing.T) {
+	testMultiConcurrencies(t, "executor-set-concurrency", testExecutorSetConcurrency)
+}
+func testExecutorSetConcurrency(t *testing.T, numRoutines int) {
+	ctx := context.Background()
+	inputCount := 1000
+	inputChan := make(chan int)
+	var processed int64 = 0
+	executor := Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-set-concurrency",
+		Concurrency:       numRoutines,
+		OutputChannelSize: inputCount,
+		InputChannel:      inputChan,
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			atomic.AddInt64(&processed, 1)
+			return input, nil
+		},
+	})
+
+	// Raise the concurrency
+	raised := 2 * numRoutines
+	executor.SetConcurrency(raised)
+	if executor.Concurrency() != raised {
+		t.Fatalf("Expected a concurrency of %d, but got %d", raised, executor.Concurrency())
+	}
+	if running := executor.RoutineStatusTracker.GetNumRoutinesRunning(); running != int32(raised) {
+		t.Fatalf("Expected %d routines to be running, but got %d", raised, running)
+	}
+	for i := 0; i < inputCount/2; i++ {
+		inputChan <- i
+	}
+
+	// Lower the concurrency, and wait for the idle routines to retire
+	executor.SetConcurrency(1)
+	deadline := time.Now().Add(10 * time.Second)
+	for executor.RoutineStatusTracker.GetNumRoutinesRunning() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 1 routine to be running, but got %d", executor.RoutineStatusTracker.GetNumRoutinesRunning())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if retired := executor.RoutineStatusTracker.GetNumRoutinesRetired(); retired != int32(raised-1) {
+		t.Fatalf("Expected %d routines to have retired, but got %d", raised-1, retired)
+	}
+	for i := inputCount / 2; i < inputCount; i++ {
+		inputChan <- i
+	}
+	close(inputChan)
+
+	if err := executor.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if int(atomic.LoadInt64(&processed)) != inputCount {
+		t.Fatalf("Processed %d inputs, but expected %d", processed, inputCount)
+	}
+	if len(executor.OutputChan) != inputCount {
+		t.Fatalf("Expected %d outputs, but got %d", inputCount, len(executor.OutputChan))
+	}
+	if finished := executor.RoutineStatusTracker.GetNumRoutinesFinished(); finished != 1 {
+		t.Fatalf("Expected 1 routine to have finished, but got %d", finished)
+	}
+
+	// Changing the concurrency of a finished executor does nothing
+	executor.SetConcurrency(numRoutines)
+	if running := executor.RoutineStatusTracker.GetNumRoutinesRunning(); running != 0 {
+		t.Fatalf("Expected no routines to be running, but got %d", running)
+	}
+	testVerifyCleanup(t, executor)
+}
+
+func TestExecutorAutoScale(t *testing.T) {
+	ctx := context.Background()
+	inputCount := 500
+	inputChan := make(chan int, inputCount)
+	var lock sync.Mutex
+	decisions := []*AutoScaleCallbackInput{}
+	executor := Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-auto-scale",
+		OutputChannelSize: inputCount,
+		InputChannel:      inputChan,
+		AutoScale: AutoScale{
+			MinConcurrency: 2,
+			MaxConcurrency: 16,
+			Interval:       10 * time.Millisecond,
+			Cooldown:       20 * time.Millisecond,
+			Callback: func(input *AutoScaleCallbackInput) stackerr.Error {
+				lock.Lock()
+				defer lock.Unlock()
+				decisions = append(decisions, input)
+				return nil
+			},
+		},
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			time.Sleep(2 * time.Millisecond)
+			return input, nil
+		},
+	})
+	if executor.Concurrency() != 2 {
+		t.Fatalf("Expected to start with the minimum of 2 routines, but started with %d", executor.Concurrency())
+	}
+
+	// A backlog builds up, so the executor should grow to the maximum
+	for i := 0; i < inputCount; i++ {
+		inputChan <- i
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for executor.Concurrency() != 16 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the executor to grow to 16 routines, but it has %d", executor.Concurrency())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Once the backlog is gone, the routines sit idle, so it should shrink back to the minimum
+	for executor.Concurrency() != 2 || executor.RoutineStatusTracker.GetNumRoutinesRunning() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the executor to shrink to 2 routines, but it has %d", executor.Concurrency())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(inputChan)
+	if err := executor.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if len(executor.OutputChan) != inputCount {
+		t.Fatalf("Expected %d outputs, but got %d", inputCount, len(executor.OutputChan))
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for i, decision := range decisions {
+		if decision.NewConcurrency < 2 || decision.NewConcurrency > 16 {
+			t.Fatalf("Scaled to %d routines, outside of the bounds", decision.NewConcurrency)
+		}
+		if i > 0 && decision.PreviousConcurrency != decisions[i-1].NewConcurrency {
+			t.Fatalf("Scaled from %d routines, but the previous decision scaled to %d", decision.PreviousConcurrency, decisions[i-1].NewConcurrency)
+		}
+	}
+	testVerifyCleanup(t, executor)
+
+	// If the callback returns an error, the executor fails with it
+	errScale := errors.New("scale callback failed")
+	var executorErr stackerr.Error
+	executor = Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-autoscale-error",
+		OutputChannelSize: inputCount,
+		InputChannel:      RangeToChan(0, inputCount),
+		AutoScale: AutoScale{
+			MaxConcurrency: 16,
+			Interval:       10 * time.Millisecond,
+			Callback: func(input *AutoScaleCallbackInput) stackerr.Error {
+				return stackerr.Wrap(errScale)
+			},
+		},
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			time.Sleep(2 * time.Millisecond)
+			return input, nil
+		},
+		ExecutorErrorCallback: func(input *ExecutorErrorCallbackInput) stackerr.Error {
+			executorErr = input.Err
+			return nil
+		},
+		ExecutorContextDoneCallback: func(input *ExecutorContextDoneCallbackInput) stackerr.Error {
+			t.Errorf("Expected the executor to fail, but it was cancelled with %v", input.Err)
+			return nil
+		},
+	})
+	if err := executor.Wait(); !errors.Is(err, errScale) || errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the error from the callback, but received %v", err)
+	}
+	if !errors.Is(executorErr, errScale) {
+		t.Fatalf("Expected the executor error callback to get the error from the callback, but it got %v", executorErr)
+	}
+	testVerifyCleanup(t, executor)
+}
+
+func TestExecutorAdaptiveLimit(t *testing.T) {
+	ctx := context.Background()
+	inputCount := 2000
+	// The downstream service gets slow once more than this many calls are in flight
+	capacity := int64(5)
+	for _, algorithm := range []AdaptiveLimitAlgorithm{AdaptiveLimitAIMD, AdaptiveLimitGradient} {
+		var inFlight int64 = 0
+		executor := Executor(ctx, ExecutorInput[int, int]{
+			Name:              "test-executor-adaptive-limit-" + algorithm.String(),
+			Concurrency:       50,
+			OutputChannelSize: inputCount,
+			InputChannel:      RangeToChan(0, inputCount),
+			AdaptiveLimit: AdaptiveLimit{
+				MaxLimit:         50,
+				Algorithm:        algorithm,
+				LatencyThreshold: 5 * time.Millisecond,
+			},
+			Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+				current := atomic.AddInt64(&inFlight, 1)
+				defer atomic.AddInt64(&inFlight, -1)
+				if current > capacity {
+					time.Sleep(10 * time.Millisecond)
+				} else {
+					time.Sleep(time.Millisecond)
+				}
+				return input, nil
+			},
+		})
+		if err := executor.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		// The limit should have grown from the minimum, but stayed well
+		// under the maximum because of the slow calls.
+		limit := executor.RoutineStatusTracker.GetAdaptiveLimit()
+		if limit < 2 || limit > 25 {
+			t.Fatalf("%s: expected the limit to settle near %d, but it's %d", algorithm, capacity, limit)
+		}
+		testVerifyCleanup(t, executor)
+	}
+}
+
+func TestExecutorPause(t *testing.T) {
+	testMultiConcurrencies(t, "executor-pause", testExecutorPause)
+}
+func testExecutorPause(t *testing.T, numRoutines int) {
+	ctx := context.Background()
+	inputCount := 100
+	inputChan := make(chan int, inputCount)
+	var processed int32 = 0
+	var emptyCallbacks int32 = 0
+	executor := Executor(ctx, ExecutorInput[int, int]{
+		Name:                              "test-executor-pause",
+		Concurrency:                       numRoutines,
+		OutputChannelSize:                 inputCount,
+		InputChannel:                      inputChan,
+		EmptyInputChannelCallbackInterval: time.Millisecond,
+		EmptyInputChannelCallback: func(input *EmptyInputChannelCallbackInput) stackerr.Error {
+			atomic.AddInt32(&emptyCallbacks, 1)
+			return nil
+		},
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			atomic.AddInt32(&processed, 1)
+			return input, nil
+		},
+	})
+	executor.Pause()
+	if !executor.IsPaused() {
+		t.Fatalf("Expected the executor to be paused")
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for executor.RoutineStatusTracker.GetNumRoutinesPaused() != int32(numRoutines) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d routines to be paused, but got %d", numRoutines, executor.RoutineStatusTracker.GetNumRoutinesPaused())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Nothing should be taken from the input channel while paused
+	atomic.StoreInt32(&emptyCallbacks, 0)
+	for i := 0; i < inputCount; i++ {
+		inputChan <- i
+	}
+	time.Sleep(20 * time.Millisecond)
+	if p := atomic.LoadInt32(&processed); p != 0 {
+		t.Fatalf("Expected no inputs to be processed while paused, but %d were", p)
+	}
+	if len(inputChan) != inputCount {
+		t.Fatalf("Expected %d inputs to remain in the input channel, but there are %d", inputCount, len(inputChan))
+	}
+	if c := atomic.LoadInt32(&emptyCallbacks); c != 0 {
+		t.Fatalf("Expected no empty input callbacks while paused, but got %d", c)
+	}
+	if executor.Ctx().Err() != nil {
+		t.Fatalf("Expected the context not to be done while paused")
+	}
+
+	executor.Resume()
+	close(inputChan)
+	if err := executor.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if p := atomic.LoadInt32(&processed); int(p) != inputCount {
+		t.Fatalf("Processed %d inputs, but expected %d", p, inputCount)
+	}
+	if executor.RoutineStatusTracker.GetNumRoutinesPaused() != 0 {
+		t.Fatalf("Expected no routines to be paused after finishing")
+	}
+	testVerifyCleanup(t, executor)
+}
+
+func TestExecutorSupervisor(t *testing.T) {
+	testMultiConcurrencies(t, "executor-supervisor", testExecutorSupervisor)
+}
+func testExecutorSupervisor(t *testing.T, numRoutines int) {
+	ctx := context.Background()
+	inputCount := 100
+	// Every tenth input fails, alternating between errors and panics
+	process := func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+		if input%10 == 0 {
+			if input%20 == 0 {
+				panic(fmt.Sprintf("panic on input %d", input))
+			}
+			return 0, stackerr.Errorf("error on input %d", input)
+		}
+		return input, nil
+	}
+
+	for _, scope := range []SupervisorScope{SupervisorScopeRoutine, SupervisorScopeExecutor} {
+		var callbacks int32 = 0
+		executor := Executor(ctx, ExecutorInput[int, int]{
+			Name:              "test-executor-supervisor",
+			Concurrency:       numRoutines,
+			OutputChannelSize: inputCount,
+			InputChannel:      RangeToChan(0, inputCount),
+			Supervisor: Supervisor{
+				MaxRestarts:    inputCount,
+				Scope:          scope,
+				InitialBackoff: time.Microsecond,
+				MaxBackoff:     time.Millisecond,
+				Callback: func(input *RoutineRestartCallbackInput) stackerr.Error {
+					atomic.AddInt32(&callbacks, 1)
+					if input.Err == nil || input.Backoff <= 0 || input.Restarts < 1 {
+						t.Errorf("Unexpected restart callback input: %+v", input)
+					}
+					return nil
+				},
+			},
+			Func: process,
+		})
+		if err := executor.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		if len(executor.OutputChan) != inputCount-10 {
+			t.Fatalf("Expected %d outputs with the %s scope, but got %d", inputCount-10, scope, len(executor.OutputChan))
+		}
+		if r := executor.RoutineStatusTracker.GetNumRestarts(); r != 10 || atomic.LoadInt32(&callbacks) != 10 {
+			t.Fatalf("Expected 10 restarts with the %s scope, but got %d (%d callbacks)", scope, r, callbacks)
+		}
+		if executor.RoutineStatusTracker.GetNumRoutinesRestarting() != 0 || executor.RoutineStatusTracker.GetNumRoutinesErrored() != 0 {
+			t.Fatalf("Expected no routines to be restarting or errored after finishing")
+		}
+		testVerifyCleanup(t, executor)
+	}
+
+	// Once there are too many restarts within the window, the executor fails
+	executor := Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-supervisor-escalate",
+		Concurrency:       numRoutines,
+		OutputChannelSize: inputCount,
+		InputChannel:      RangeToChan(0, inputCount),
+		Supervisor: Supervisor{
+			MaxRestarts:    3,
+			Window:         time.Minute,
+			InitialBackoff: time.Microsecond,
+		},
+		Func: process,
+	})
+	if err := executor.Wait(); err == nil {
+		t.Fatalf("Expected the executor to fail after too many restarts")
+	}
+	if r := executor.RoutineStatusTracker.GetNumRestarts(); r != 3 {
+		t.Fatalf("Expected 3 restarts before failing, but got %d", r)
+	}
+	testVerifyCleanup(t, executor)
+}
+
+func TestExecutorWatchdog(t *testing.T) {
+	ctx := context.Background()
+	inputCount := 10
+	unblock := make(chan struct{})
+	process := func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+		select {
+		case <-ctx.Done():
+		case <-unblock:
+		}
+		return input, nil
+	}
+
+	// The callback gets a report of the stall once
+	reports := make(chan *StallReport, inputCount)
+	var watchdogInput *BaseExecutorCallbackInput
+	var successInput *BaseExecutorCallbackInput
+	executor := Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-watchdog",
+		Concurrency:       2,
+		OutputChannelSize: inputCount,
+		InputChannel:      RangeToChan(0, inputCount),
+		Watchdog: Watchdog{
+			StallTimeout: 20 * time.Millisecond,
+			Interval:     time.Millisecond,
+			Callback: func(input *StallCallbackInput) stackerr.Error {
+				watchdogInput = input.BaseExecutorCallbackInput
+				reports <- input.Report
+				return nil
+			},
+		},
+		ExecutorSuccessCallback: func(input *ExecutorSuccessCallbackInput) stackerr.Error {
+			successInput = input.BaseExecutorCallbackInput
+			return nil
+		},
+		Func: process,
+	})
+	var report *StallReport
+	select {
+	case report = <-reports:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected the watchdog to report a stall")
+	}
+	if report.ExecutorName != "test-executor-watchdog" || report.TimeSinceProgress <= 20*time.Millisecond {
+		t.Fatalf("Unexpected stall report: %+v", report)
+	}
+	if len(report.Routines) != 2 {
+		t.Fatalf("Expected 2 routines in the stall report, but got %d", len(report.Routines))
+	}
+	for i, routine := range report.Routines {
+		if routine.RoutineIndex != uint(i) || routine.Status != Processing || routine.ExecutorInputIndex > 1 {
+			t.Fatalf("Unexpected routine in the stall report: %+v", routine)
+		}
+	}
+	if !strings.Contains(report.Stacks, "TestExecutorWatchdog") || !strings.Contains(report.Stacks, `"concurrency_executor":"test-executor-watchdog"`) {
+		t.Fatalf("Expected the stacks of the executor's routines, but got:\n%s", report.Stacks)
+	}
+	close(unblock)
+	if err := executor.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 0 {
+		t.Fatalf("Expected the stall to be reported once, but got %d more reports", len(reports))
+	}
+	// The values set for the executor callbacks don't change the ones the watchdog has
+	if successInput == nil || successInput.Utilization == nil || successInput.ExecutorName != "test-executor-watchdog" {
+		t.Fatalf("Unexpected executor success callback input: %+v", successInput)
+	}
+	if watchdogInput == successInput || watchdogInput.Utilization != nil || watchdogInput.ExecutorName != "test-executor-watchdog" {
+		t.Fatalf("Unexpected watchdog callback input: %+v", watchdogInput)
+	}
+	testVerifyCleanup(t, executor)
+
+	// With FailChain, the executor fails with a StallError
+	var executorErr stackerr.Error
+	executor = Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-watchdog-fail",
+		Concurrency:       2,
+		OutputChannelSize: inputCount,
+		InputChannel:      RangeToChan(0, inputCount),
+		Watchdog: Watchdog{
+			StallTimeout: 20 * time.Millisecond,
+			Interval:     time.Millisecond,
+			FailChain:    true,
+		},
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			<-ctx.Done()
+			return input, nil
+		},
+		ExecutorErrorCallback: func(input *ExecutorErrorCallbackInput) stackerr.Error {
+			executorErr = input.Err
+			return nil
+		},
+		ExecutorContextDoneCallback: func(input *ExecutorContextDoneCallbackInput) stackerr.Error {
+			t.Errorf("Expected the executor to fail, but it was cancelled with %v", input.Err)
+			return nil
+		},
+	})
+	err := executor.Wait()
+	var stallErr *StallError
+	if !errors.As(err, &stallErr) || stallErr.Report.ExecutorName != "test-executor-watchdog-fail" || errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a StallError, but received %v", err)
+	}
+	if !errors.As(executorErr, &stallErr) {
+		t.Fatalf("Expected the executor error callback to get a StallError, but it got %v", executorErr)
+	}
+	testVerifyCleanup(t, executor)
+}
+
+func TestExecutorHeartbeat(t *testing.T) {
+	ctx := context.Background()
+	var heartbeatErr error
+	executor := Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-heartbeat",
+		Concurrency:       1,
+		OutputChannelSize: 2,
+		InputChannel:      RangeToChan(0, 2),
+		HeartbeatTimeout:  30 * time.Millisecond,
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			if input == 0 {
+				// A call that takes longer than the timeout, but keeps sending heartbeats
+				for i := 0; i < 5; i++ {
+					time.Sleep(10 * time.Millisecond)
+					metadata.Heartbeat(i)
+					heartbeat, ok := metadata.RoutineStatusTracker.GetHeartbeat(metadata.RoutineIndex)
+					if !ok || heartbeat.Progress != i || time.Since(heartbeat.Time) > time.Second {
+						heartbeatErr = fmt.Errorf("unexpected heartbeat: %+v", heartbeat)
+					}
+					if len(metadata.RoutineStatusTracker.GetHeartbeats()) != 1 {
+						heartbeatErr = fmt.Errorf("expected 1 routine with a heartbeat")
+					}
+				}
+				return input, nil
+			}
+			// A call that stops sending heartbeats
+			<-ctx.Done()
+			return 0, stackerr.Wrap(ctx.Err())
+		},
+	})
+	err := executor.Wait()
+	if !errors.Is(err, ErrHeartbeatTimeout) {
+		t.Fatalf("Expected the executor to fail with %v, but received %v", ErrHeartbeatTimeout, err)
+	}
+	if heartbeatErr != nil {
+		t.Fatal(heartbeatErr)
+	}
+	if len(executor.OutputChan) != 1 {
+		t.Fatalf("Expected the call with heartbeats to succeed")
+	}
+	testVerifyCleanup(t, executor)
+}
+
+func TestRoutineStatusValues(t *testing.T) {
+	// The values of the statuses never change, since they may have been stored or compared
+	statuses := []routineStatus{AwaitingInput, Processing, AwaitingOutput, Errored, ContextDone, Finished, RateLimited, AwaitingLimiter, Retired, Paused, Restarting}
+	if len(statuses) != numRoutineStatuses {
+		t.Fatalf("Expected %d statuses, but there are %d", len(statuses), numRoutineStatuses)
+	}
+	for i, status := range statuses {
+		if int(status) != i {
+			t.Fatalf("Expected %s to have the value %d, but it has %d", status, i, int(status))
+		}
+	}
+}
+
+func TestExecutorRoutines(t *testing.T) {
+	ctx := context.Background()
+	inputCount := 10
+	unblock := make(chan struct{})
+	var blocked int32 = 0
+	executor := Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-routines",
+		Concurrency:       2,
+		OutputChannelSize: inputCount,
+		InputChannel:      RangeToChan(0, inputCount),
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			if input == 3 {
+				return 0, stackerr.Errorf("error on input %d", input)
+			}
+			if input == inputCount-1 {
+				atomic.StoreInt32(&blocked, 1)
+				<-unblock
+			}
+			return input, nil
+		},
+		Fallback: func(ctx context.Context, input int, err stackerr.Error, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			return input, nil
+		},
+	})
+
+	// While one routine is stuck on the last input, the other one has finished
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt32(&blocked) == 0 || executor.RoutineStatusTracker.GetNumRoutinesFinished() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected one routine to be stuck on the last input")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	routines := executor.RoutineStatusTracker.Routines()
+	if len(routines) != 2 {
+		t.Fatalf("Expected 2 routines, but got %d", len(routines))
+	}
+	var processing, finished int
+	for i, routine := range routines {
+		if routine.RoutineIndex != uint(i) {
+			t.Fatalf("Expected the routines to be in order of their index, but got %+v", routines)
+		}
+		if routine.Status == Processing {
+			processing++
+			if time.Since(routine.StatusSince) < 10*time.Millisecond || routine.ExecutorInputIndex >= uint64(inputCount) {
+				t.Fatalf("Unexpected state of the processing routine: %+v", routine)
+			}
+		}
+		if routine.Status == Finished {
+			finished++
+		}
+	}
+	if processing != 1 || finished != 1 {
+		t.Fatalf("Expected 1 routine to be processing and 1 to be finished, but got %+v", routines)
+	}
+
+	close(unblock)
+	if err := executor.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	var numProcessed uint64
+	var numErrors int
+	for _, routine := range executor.RoutineStatusTracker.Routines() {
+		if routine.Status != Finished {
+			t.Fatalf("Expected all routines to be finished, but got %+v", routine)
+		}
+		numProcessed += routine.NumProcessed
+		if routine.LastError != nil {
+			numErrors++
+			if !strings.Contains(routine.LastError.Error(), "error on input 3") {
+				t.Fatalf("Unexpected last error: %v", routine.LastError)
+			}
+		}
+	}
+	if numProcessed != uint64(inputCount) || numErrors != 1 {
+		t.Fatalf("Expected %d inputs to be processed and 1 routine with an error, but got %d and %d", inputCount, numProcessed, numErrors)
+	}
+	testVerifyCleanup(t, executor)
+
+	// Only the most recent routines that have exited are kept
+	for _, maxExited := range []int{-1, 1, 3} {
+		executor = Executor(ctx, ExecutorInput[int, int]{
+			Name:              "test-executor-routines-max-exited",
+			Concurrency:       3,
+			OutputChannelSize: inputCount,
+			InputChannel:      RangeToChan(0, inputCount),
+			MaxExitedRoutines: maxExited,
+			Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+				return input, nil
+			},
+		})
+		if err := executor.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		expected := maxExited
+		if expected < 0 {
+			expected = 0
+		}
+		if routines := executor.RoutineStatusTracker.Routines(); len(routines) != expected {
+			t.Fatalf("Expected %d routines to be kept, but got %+v", expected, routines)
+		}
+		testVerifyCleanup(t, executor)
+	}
+}
+
+func TestExecutorUtilization(t *testing.T) {
+	ctx := context.Background()
+	inputCount := 20
+	var utilization *Utilization
+	executor := Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-utilization",
+		Concurrency:       2,
+		OutputChannelSize: inputCount,
+		InputChannel:      RangeToChan(0, inputCount),
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			time.Sleep(5 * time.Millisecond)
+			return input, nil
+		},
+		ExecutorSuccessCallback: func(input *ExecutorSuccessCallbackInput) stackerr.Error {
+			utilization = input.Utilization
+			return nil
+		},
+	})
+	if err := executor.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if utilization == nil {
+		t.Fatalf("Expected the success callback to get the utilization")
+	}
+	sum := utilization.AwaitingInput + utilization.Processing + utilization.AwaitingOutput + utilization.RateLimited + utilization.AwaitingLimiter + utilization.Paused + utilization.Restarting
+	if math.Abs(sum-1) > 0.001 {
+		t.Fatalf("Expected the utilization ratios to add up to 1, but got %+v", utilization)
+	}
+	// Nearly all of the time is spent sleeping in the processing function
+	if utilization.Processing < 0.5 {
+		t.Fatalf("Expected most of the time to be spent processing, but got %+v", utilization)
+	}
+	if processing := executor.RoutineStatusTracker.GetTimeInStatus(Processing); processing < time.Duration(inputCount)*5*time.Millisecond {
+		t.Fatalf("Expected at least %s to be spent processing, but got %s", time.Duration(inputCount)*5*time.Millisecond, processing)
+	}
+	if *executor.RoutineStatusTracker.GetUtilization() != *utilization {
+		t.Fatalf("Expected the tracker to report the same utilization as the callback once finished")
+	}
+	var routineTime time.Duration
+	for _, routine := range executor.RoutineStatusTracker.Routines() {
+		if routine.Utilization.Processing < 0.5 {
+			t.Fatalf("Expected most of each routine's time to be spent processing, but got %+v", routine.Utilization)
+		}
+		routineTime += routine.Utilization.RoutineTime
+	}
+	if routineTime != utilization.RoutineTime {
+		t.Fatalf("Expected the routine times to add up to %s, but got %s", utilization.RoutineTime, routineTime)
+	}
+	testVerifyCleanup(t, executor)
+}
+
+func TestExecutorRequeue(t *testing.T) {
+	testMultiConcurrencies(t, "executor-requeue", testExecutorRequeue)
+}
+func testExecutorRequeue(t *testing.T, numRoutines int) {
+	ctx := context.Background()
+	inputCount := 1000
+	maxRequeues := 3
+	var quarantined int32 = 0
+	executor := Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-requeue-1",
+		Concurrency:       numRoutines,
+		OutputChannelSize: inputCount,
+		InputChannel:      RangeToChan(0, inputCount),
+		MaxRequeues:       maxRequeues,
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			// This input can never succeed
+			if input == 7 {
+				return 0, Requeue(0)
+			}
+			// Even inputs succeed after being requeued once
+			if input%2 == 0 && metadata.RequeueCount == 0 {
+				return 0, Requeue(1 * time.Millisecond)
+			}
+			return input, nil
+		},
+		QuarantineCallback: func(input *QuarantineCallbackInput[int]) stackerr.Error {
+			if input.Input != 7 || input.RequeueCount != uint(maxRequeues) {
+				t.Errorf("Unexpected quarantine of input %d after %d requeues", input.Input, input.RequeueCount)
+			}
+			atomic.AddInt32(&quarantined, 1)
+			return nil
+		},
+	})
+	if err := executor.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if quarantined != 1 {
+		t.Fatalf("Quarantined %d inputs, but expected 1", quarantined)
+	}
+	numOutput := 0
+	for range executor.OutputChan {
+		numOutput++
+	}
+	if numOutput != inputCount-1 {
+		t.Fatalf("Received %d outputs, but expected %d", numOutput, inputCount-1)
+	}
+	testVerifyCleanup(t, executor)
+}
+
+func TestExecutorRequeueOrder(t *testing.T) {
+	ctx := context.Background()
+	inputCount := 10
+	var processed []int
+	executor := Executor(ctx, ExecutorInput[int, int]{
+		Name:              "test-executor-requeue-order-1",
+		Concurrency:       1,
+		OutputChannelSize: inputCount,
+		InputChannel:      RangeToChan(0, inputCount),
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			processed = append(processed, input)
+			if input == 0 && metadata.RequeueCount == 0 {
+				return 0, Requeue(0)
+			}
+			return input, nil
+		},
+	})
+	if err := executor.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// The requeued input goes behind the inputs that were already waiting
+	expected := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 0}
+	if fmt.Sprint(processed) != fmt.Sprint(expected) {
+		t.Fatalf("Processed inputs in the order %v, but expected %v", processed, expected)
+	}
+	testVerifyCleanup(t, executor)
+
+	// Without a MaxRequeues, an input that's always requeued is only requeued
+	// DefaultMaxRequeues times
+	var calls int32 = 0
+	executor = Executor(ctx, ExecutorInput[int, int]{
+		Name:         "test-executor-requeue-order-2",
+		Concurrency:  1,
+		InputChannel: RangeToChan(0, 1),
+		Func: func(ctx context.Context, input int, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			atomic.AddInt32(&calls, 1)
+			return 0, Requeue(time.Millisecond)
+		},
+	})
+	if err := executor.Wait(); err == nil || !strings.Contains(err.Error(), "requeued more than the maximum") {
+		t.Fatalf("Expected an error for too many requeues, but received %v", err)
+	}
+	if int(calls) != DefaultMaxRequeues+1 {
+		t.Fatalf("Processed the input %d times, but expected %d", calls, DefaultMaxRequeues+1)
+	}
+	testVerifyCleanup(t, executor)
+
+	// Processing functions without an input have nothing to requeue
+	continuous := Continuous(ctx, ContinuousInput[int]{
+		Name: "test-executor-requeue-order-3",
+		Func: func(ctx context.Context, metadata *RoutineFunctionMetadata) (int, stackerr.Error) {
+			return 0, Requeue(0)
+		},
+	}, 0)
+	if err := continuous.Wait(); err == nil || !strings.Contains(err.Error(), "doesn't take an input") {
+		t.Fatalf("Expected an error for requeueing without an input, but received %v", err)
+	}
+	testVerifyCleanup(t, continuous)
+
+	// Inputs that are waiting for their delay when the executor exits are dropped,
+	// and their timers are stopped
+	queue := newRequeueQueue[int](func() int {
+		return 0
+	})
+	for i := 0; i < inputCount; i++ {
+		queue.Push(requeuedInput[int]{
+			input: i,
+		}, time.Hour)
+	}
+	queue.Stop()
+	queue.Push(requeuedInput[int]{}, 0)
+	if len(queue.timers) != 0 || queue.Pending() != 0 {
+		t.Fatalf("Expected the requeue queue to be cleared, but it has %d timers and %d pending inputs", len(queue.timers), queue.Pending())
+	}
+	if _, ok := queue.Pop(); ok {
+		t.Fatalf("Expected nothing to be taken from a stopped requeue queue")
+	}
+}
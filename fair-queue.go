@@ -0,0 +1,224 @@
+package concurrency
+
+import (
+	"context"
+	"sync"
+)
+
+// FairQueue is a fair scheduling mode for the inputs of an executor. Inputs are
+// queued by key, and the routines are given inputs from the keys in turn, so that
+// a key with many inputs can't starve the others.
+type FairQueue[InputType any] struct {
+	// REQUIRED. A function that gets the key of an input.
+	Key func(input InputType) string
+	// OPTIONAL. A function that gets the weight of a key, which is the number of its
+	// inputs that are given to the routines in each turn. Defaults to 1 for every key.
+	Weight func(key string) int
+	// OPTIONAL. The maximum number of inputs to hold in the queues. Once this many
+	// are queued, no more are taken from the input channel until the routines have
+	// taken some. Defaults to the twice the Concurrency value.
+	MaxQueued int
+}
+
+type fairQueue[InputType any] struct {
+	key       func(input InputType) string
+	weight    func(key string) int
+	maxQueued int
+	// The channel that the routines take inputs from
+	output chan requeuedInput[InputType]
+
+	// Protects the queues and counts, which are read for stats
+	lock sync.Mutex
+	// The queued inputs of each key
+	queues map[string][]requeuedInput[InputType]
+	// The number of inputs of each key that have been given to the routines
+	served map[string]uint64
+	// The total number of queued inputs
+	total int
+
+	// The keys that have queued inputs, in the order they take turns. These
+	// are only used by the dispatcher, so they don't need the lock.
+	active []string
+	// The position in active of the key whose turn it is
+	current int
+	// The number of inputs given to the routines in the current turn
+	servedInTurn int
+}
+
+func newFairQueue[InputType any](settings FairQueue[InputType], maxQueued int) *fairQueue[InputType] {
+	if settings.Key == nil {
+		return nil
+	}
+	if maxQueued < 1 {
+		maxQueued = 1
+	}
+	return &fairQueue[InputType]{
+		key:       settings.Key,
+		weight:    settings.Weight,
+		maxQueued: maxQueued,
+		output:    make(chan requeuedInput[InputType]),
+		queues:    map[string][]requeuedInput[InputType]{},
+		served:    map[string]uint64{},
+	}
+}
+
+func (fq *fairQueue[InputType]) push(entry requeuedInput[InputType]) {
+	key := fq.key(entry.input)
+	fq.lock.Lock()
+	defer fq.lock.Unlock()
+	if len(fq.queues[key]) == 0 {
+		// The key joins the end of the turn order
+		fq.active = append(fq.active, key)
+	}
+	fq.queues[key] = append(fq.queues[key], entry)
+	fq.total++
+}
+
+// peek returns the input that should be given to the routines next.
+func (fq *fairQueue[InputType]) peek() requeuedInput[InputType] {
+	fq.lock.Lock()
+	defer fq.lock.Unlock()
+	return fq.queues[fq.active[fq.current]][0]
+}
+
+// pop removes the input that was returned by peek, and moves on to the next key
+// if the current key has used up its turn.
+func (fq *fairQueue[InputType]) pop() {
+	fq.lock.Lock()
+	defer fq.lock.Unlock()
+	key := fq.active[fq.current]
+	queue := fq.queues[key]
+	// Don't hold on to the input in the backing array
+	queue[0] = requeuedInput[InputType]{}
+	queue = queue[1:]
+	fq.total--
+	fq.served[key]++
+	fq.servedInTurn++
+	if len(queue) == 0 {
+		// The key has nothing left, so it leaves the turn order
+		delete(fq.queues, key)
+		fq.active = append(fq.active[:fq.current], fq.active[fq.current+1:]...)
+		fq.servedInTurn = 0
+	} else {
+		fq.queues[key] = queue
+		weight := 1
+		if fq.weight != nil {
+			weight = fq.weight(key)
+		}
+		if fq.servedInTurn < weight {
+			return
+		}
+		fq.current++
+		fq.servedInTurn = 0
+	}
+	if fq.current >= len(fq.active) {
+		fq.current = 0
+	}
+}
+
+// queued returns the total number of queued inputs.
+func (fq *fairQueue[InputType]) queued() int {
+	fq.lock.Lock()
+	defer fq.lock.Unlock()
+	return fq.total
+}
+
+// stats returns the number of queued inputs and the number of inputs given
+// to the routines, for each key.
+func (fq *fairQueue[InputType]) stats() (depths map[string]int, served map[string]uint64) {
+	fq.lock.Lock()
+	defer fq.lock.Unlock()
+	depths = make(map[string]int, len(fq.queues))
+	for key, queue := range fq.queues {
+		depths[key] = len(queue)
+	}
+	served = make(map[string]uint64, len(fq.served))
+	for key, count := range fq.served {
+		served[key] = count
+	}
+	return depths, served
+}
+
+// run takes inputs from the input channel into the queues, and gives them to the
+// routines in turn. It closes the output channel once the input channel is closed
+// and everything has been given to the routines.
+func (fq *fairQueue[InputType]) run(ctx context.Context, inputChan <-chan InputType, edge *trackedEdge, tracker *itemTracker, createRoots bool, pauser *pauser, drained <-chan struct{}) {
+	// If items are being tracked through the chain, we can only receive from the
+	// input channel while holding the edge's receive token.
+	holdingRecvToken := false
+	defer func() {
+		if holdingRecvToken {
+			edge.releaseRecv()
+		}
+	}()
+	inputChanClosed := false
+	for {
+		if inputChanClosed && fq.total == 0 {
+			close(fq.output)
+			return
+		}
+
+		// While the executor is paused, nothing is taken from the input channel
+		paused, pauseChanged := pauser.isPaused()
+		if paused && holdingRecvToken {
+			edge.releaseRecv()
+			holdingRecvToken = false
+		}
+
+		var in <-chan InputType
+		var recvToken <-chan struct{}
+		if !inputChanClosed && !paused && fq.total < fq.maxQueued {
+			if edge != nil && !holdingRecvToken {
+				recvToken = edge.recvToken
+			} else {
+				in = inputChan
+			}
+		}
+		var out chan<- requeuedInput[InputType]
+		var next requeuedInput[InputType]
+		if fq.total > 0 {
+			out = fq.output
+			next = fq.peek()
+		}
+
+		select {
+		// The routines will exit on the context as well, so there's no need to
+		// close the output channel.
+		case <-ctx.Done():
+			return
+
+		case <-pauseChanged:
+
+		// The chain is being drained, so stop taking new inputs, and
+		// treat it as if the input channel was closed.
+		case <-drained:
+			inputChanClosed = true
+			drained = nil
+
+		case <-recvToken:
+			holdingRecvToken = true
+
+		case input, ok := <-in:
+			if !ok {
+				inputChanClosed = true
+				continue
+			}
+			entry := requeuedInput[InputType]{
+				input: input,
+			}
+			if edge != nil {
+				// Take the input's lineage off the edge
+				entry.lineage = edge.pop()
+				edge.releaseRecv()
+				holdingRecvToken = false
+			} else if createRoots {
+				// This is the first tracked executor, so the input starts a new lineage
+				entry.lineage = tracker.newRoot()
+			}
+			fq.push(entry)
+
+		case out <- next:
+			fq.pop()
+		}
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/Invicton-Labs/go-concurrency
 
-go 1.18
+go 1.20
 
 require (
 	github.com/Invicton-Labs/go-stackerr v0.1.0
@@ -0,0 +1,215 @@
+package concurrency
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// StageState is the state of an executor in a health report.
+type StageState int
+
+const (
+	// The executor is running normally
+	StageStateRunning StageState = iota
+	// The executor is paused
+	StageStatePaused
+	// The chain is being drained, and the executor is finishing the inputs it has
+	StageStateDraining
+	// The executor has work, but hasn't made any progress for longer than allowed
+	StageStateStalled
+	// One or more routines of the executor failed
+	StageStateErrored
+	// The executor was stopped by its context being cancelled
+	StageStateCancelled
+	// The executor finished successfully
+	StageStateFinished
+)
+
+func (s StageState) String() string {
+	switch s {
+	case StageStateRunning:
+		return "Running"
+	case StageStatePaused:
+		return "Paused"
+	case StageStateDraining:
+		return "Draining"
+	case StageStateStalled:
+		return "Stalled"
+	case StageStateErrored:
+		return "Errored"
+	case StageStateCancelled:
+		return "Cancelled"
+	case StageStateFinished:
+		return "Finished"
+	default:
+		return "Unknown"
+	}
+}
+
+// MarshalText encodes the state as its name, so that it's readable in JSON.
+func (s StageState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// HealthRules are the conditions under which a chain is reported as unhealthy, in
+// addition to any of its executors having failed or been cancelled.
+type HealthRules struct {
+	// OPTIONAL. The number of errors of an executor's processing function (see
+	// GetNumErrors on the RoutineStatusTracker) at which the chain is unhealthy,
+	// even if the errors were handled. If 0, handled errors don't affect the health.
+	MaxErrors uint64
+	// OPTIONAL. How long an executor that has work (inputs waiting, or inputs being
+	// processed or output) can go without finishing the processing of an input before
+	// it's stalled, which makes the chain unhealthy. If 0, executors are never stalled.
+	MaxTimeWithoutProgress time.Duration
+	// OPTIONAL. How long an executor's output channel can be full before the chain is
+	// unhealthy. If 0, full output channels don't affect the health.
+	MaxTimeOutputChanFull time.Duration
+}
+
+// StageHealth is the health of one executor in a chain.
+type StageHealth struct {
+	// The name of the executor
+	ExecutorName string `json:"executor_name"`
+	// The state of the executor
+	State StageState `json:"state"`
+	// The number of routines that are running
+	NumRoutinesRunning int32 `json:"num_routines_running"`
+	// The number of inputs the processing function has finished
+	NumProcessed uint64 `json:"num_processed"`
+	// The number of errors of the processing function
+	NumErrors uint64 `json:"num_errors"`
+	// How long it's been since the processing function last finished an input
+	TimeSinceProgress time.Duration `json:"time_since_progress_ns"`
+	// How long the output channel has been full, or 0 if it isn't
+	TimeOutputChanFull time.Duration `json:"time_output_chan_full_ns"`
+	// The number of inputs waiting in the input channel
+	InputChanLength int `json:"input_chan_length"`
+	// The number of outputs waiting in the output channel, or nil if there isn't one
+	OutputChanLength *int `json:"output_chan_length"`
+	// Why the executor makes the chain unhealthy, if it does
+	Problems []string `json:"problems,omitempty"`
+}
+
+// HealthReport is the health of a chain, for liveness and readiness probes.
+type HealthReport struct {
+	// Whether none of the executors have failed, been cancelled or broken any
+	// of the rules. A chain that has finished successfully is still healthy.
+	Healthy bool `json:"healthy"`
+	// Whether the chain is healthy and all of its executors are running (not
+	// paused, draining or finished).
+	Ready bool `json:"ready"`
+	// The health of each executor in the chain, in the order of the chain
+	Stages []StageHealth `json:"stages"`
+	// When the report was made
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// stageHealth checks the health of the executor that the tracker belongs to.
+func (rst *RoutineStatusTracker) stageHealth(rules HealthRules, now time.Time) StageHealth {
+	running := rst.GetNumRoutinesRunning()
+	stage := StageHealth{
+		ExecutorName:       rst.GetExecutorName(),
+		NumRoutinesRunning: running,
+		NumProcessed:       rst.GetNumProcessed(),
+		NumErrors:          rst.GetNumErrors(),
+		TimeSinceProgress:  now.Sub(rst.GetLastProgress()),
+		InputChanLength:    rst.GetInputChanLength(),
+		OutputChanLength:   rst.GetOutputChanLength(),
+	}
+	// If the channel is full now, it has been full since the last output
+	// was put into it, since nothing else could have filled it again.
+	if stage.OutputChanLength != nil && rst.outputChanCapacity > 0 && *stage.OutputChanLength >= rst.outputChanCapacity {
+		stage.TimeOutputChanFull = now.Sub(rst.getLastOutput())
+	}
+
+	switch {
+	case rst.GetNumRoutinesErrored() > 0:
+		stage.State = StageStateErrored
+		stage.Problems = append(stage.Problems, "routines failed")
+	case running == 0 && rst.GetNumRoutinesContextDone() > 0:
+		stage.State = StageStateCancelled
+		stage.Problems = append(stage.Problems, "cancelled")
+	case running == 0:
+		stage.State = StageStateFinished
+	case rules.MaxTimeWithoutProgress > 0 && rst.hasWork() && stage.TimeSinceProgress > rules.MaxTimeWithoutProgress:
+		stage.State = StageStateStalled
+		stage.Problems = append(stage.Problems, fmt.Sprintf("no progress for %s", stage.TimeSinceProgress))
+	case rst.isDraining != nil && rst.isDraining():
+		stage.State = StageStateDraining
+	case rst.isPaused != nil && rst.isPaused():
+		stage.State = StageStatePaused
+	default:
+		stage.State = StageStateRunning
+	}
+
+	if rules.MaxErrors > 0 && stage.NumErrors >= rules.MaxErrors {
+		stage.Problems = append(stage.Problems, fmt.Sprintf("%d errors, which is at least the maximum of %d", stage.NumErrors, rules.MaxErrors))
+	}
+	if rules.MaxTimeOutputChanFull > 0 && running > 0 && stage.TimeOutputChanFull > rules.MaxTimeOutputChanFull {
+		stage.Problems = append(stage.Problems, fmt.Sprintf("output channel full for %s", stage.TimeOutputChanFull))
+	}
+	return stage
+}
+
+// Health reports the state of each executor in the chain, up to and including this
+// one, and whether the chain is healthy and ready according to the rules.
+func (eo *ExecutorOutput[OutputChanType]) Health(rules HealthRules) *HealthReport {
+	now := time.Now()
+	report := &HealthReport{
+		Healthy:   true,
+		Ready:     true,
+		Stages:    make([]StageHealth, len(eo.routineStatusTrackersSlice)),
+		CheckedAt: now,
+	}
+	for i, tracker := range eo.routineStatusTrackersSlice {
+		stage := tracker.stageHealth(rules, now)
+		if len(stage.Problems) > 0 {
+			report.Healthy = false
+		}
+		if stage.State != StageStateRunning {
+			report.Ready = false
+		}
+		report.Stages[i] = stage
+	}
+	report.Ready = report.Ready && report.Healthy
+	return report
+}
+
+// HealthHandler returns an http.Handler that serves the health report of the chain as
+// JSON, with a 200 status if the chain is healthy and a 503 status if it isn't. It's
+// meant for liveness probes.
+func (eo *ExecutorOutput[OutputChanType]) HealthHandler(rules HealthRules) http.Handler {
+	return eo.healthHandler(rules, func(report *HealthReport) bool {
+		return report.Healthy
+	})
+}
+
+// ReadinessHandler returns an http.Handler that serves the health report of the chain
+// as JSON, with a 200 status if the chain is ready and a 503 status if it isn't. It's
+// meant for readiness probes.
+func (eo *ExecutorOutput[OutputChanType]) ReadinessHandler(rules HealthRules) http.Handler {
+	return eo.healthHandler(rules, func(report *HealthReport) bool {
+		return report.Ready
+	})
+}
+
+func (eo *ExecutorOutput[OutputChanType]) healthHandler(rules HealthRules, ok func(report *HealthReport) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := eo.Health(rules)
+		body, err := json.Marshal(report)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if ok(report) {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(body)
+	})
+}
@@ -0,0 +1,127 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The error that a call of the processing function fails with when it doesn't
+// send a heartbeat within the HeartbeatTimeout.
+var ErrHeartbeatTimeout = errors.New("the processing function stopped sending heartbeats")
+
+// Heartbeat is the last heartbeat that a routine sent from its current call of
+// the processing function.
+type Heartbeat struct {
+	// When the heartbeat was sent
+	Time time.Time
+	// The progress that was sent with the heartbeat, if any
+	Progress any
+}
+
+// routineHeartbeat tracks the heartbeats of a routine's current call of the
+// processing function.
+type routineHeartbeat struct {
+	tracker *RoutineStatusTracker
+
+	// When the current call started, in Unix nanoseconds. Only
+	// set if the executor has a HeartbeatTimeout.
+	callStart int64
+	// The last heartbeat of the current call, if there was one
+	last atomic.Pointer[Heartbeat]
+}
+
+// Heartbeat records that the processing function is still making progress, along
+// with an optional progress value. The last heartbeat of each routine's current call
+// is available from the RoutineStatusTracker. Heartbeats count as progress for the
+// Watchdog and for health reports, and they keep the call from failing if the
+// executor has a HeartbeatTimeout.
+func (rfm *RoutineFunctionMetadata) Heartbeat(progress any) {
+	if rfm.state == nil {
+		return
+	}
+	heartbeat := &rfm.state.heartbeat
+	now := time.Now()
+	heartbeat.last.Store(&Heartbeat{
+		Time:     now,
+		Progress: progress,
+	})
+	atomic.StoreInt64(&heartbeat.tracker.lastHeartbeat, now.UnixNano())
+}
+
+// startCall forgets the heartbeats of the previous call.
+func (rh *routineHeartbeat) startCall() {
+	// Most processing functions never send one, so only
+	// write if there's something to forget.
+	if rh.last.Load() != nil {
+		rh.last.Store(nil)
+	}
+}
+
+// get returns the last heartbeat of the current call, if there was one.
+func (rh *routineHeartbeat) get() (Heartbeat, bool) {
+	last := rh.last.Load()
+	if last == nil {
+		return Heartbeat{}, false
+	}
+	return *last, true
+}
+
+// deadline returns when the current call fails if it doesn't send a heartbeat.
+func (rh *routineHeartbeat) deadline(timeout time.Duration) time.Time {
+	if last := rh.last.Load(); last != nil {
+		return last.Time.Add(timeout)
+	}
+	return time.Unix(0, atomic.LoadInt64(&rh.callStart)).Add(timeout)
+}
+
+// watch starts a call of the processing function that fails if it doesn't send a
+// heartbeat within the timeout. Returns the context for the call, which is cancelled
+// with ErrHeartbeatTimeout as the cause if that happens, and a function to call once
+// the call has returned.
+func (rh *routineHeartbeat) watch(ctx context.Context, timeout time.Duration) (callCtx context.Context, stop func()) {
+	rh.startCall()
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return rh.watchTimeout(ctx, timeout)
+}
+
+// watchTimeout is the part of watch for executors with a HeartbeatTimeout. It's kept
+// separate, so that the calls of executors without one don't allocate anything.
+func (rh *routineHeartbeat) watchTimeout(ctx context.Context, timeout time.Duration) (callCtx context.Context, stop func()) {
+	atomic.StoreInt64(&rh.callStart, time.Now().UnixNano())
+	callCtx, cancel := context.WithCancelCause(ctx)
+	var timer *time.Timer
+	var timerLock sync.Mutex
+	var check func()
+	check = func() {
+		timerLock.Lock()
+		defer timerLock.Unlock()
+		if callCtx.Err() != nil {
+			return
+		}
+		if remaining := time.Until(rh.deadline(timeout)); remaining > 0 {
+			// There was a heartbeat in the meantime, so check again later
+			timer = time.AfterFunc(remaining, check)
+			return
+		}
+		cancel(ErrHeartbeatTimeout)
+	}
+	timerLock.Lock()
+	timer = time.AfterFunc(timeout, check)
+	timerLock.Unlock()
+	return callCtx, func() {
+		timerLock.Lock()
+		timer.Stop()
+		timerLock.Unlock()
+		cancel(nil)
+	}
+}
+
+// heartbeatTimedOut returns whether a call failed because it stopped sending heartbeats.
+func heartbeatTimedOut(callCtx context.Context) bool {
+	return errors.Is(context.Cause(callCtx), ErrHeartbeatTimeout)
+}
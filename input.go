@@ -18,7 +18,20 @@ type getInputSettings[
 	executorInput                     *executorInput[InputType, OutputType, OutputChanType, ProcessingFuncType]
 	emptyInputChannelCallbackInterval time.Duration
 	inputChan                         <-chan InputType
+	requeueQueue                      *requeueQueue[InputType]
+	itemTracker                       *itemTracker
+	inputEdge                         *trackedEdge
+	createRoots                       bool
+	item                              *trackedItem
 	getRoutineFunctionMetadata        func(executorInputIndex uint64, routineInputIndex uint64) *RoutineFunctionMetadata
+	rateLimiter                       *tokenBucket
+	keyedRateLimiter                  *keyedRateLimiter[InputType]
+	fairChan                          <-chan requeuedInput[InputType]
+	scaler                            *routineScaler
+	pauser                            *pauser
+	drained                           <-chan struct{}
+	routineStatusTracker              *RoutineStatusTracker
+	state                             *routineState
 }
 
 func getInput[
@@ -31,11 +44,14 @@ func getInput[
 	executorInputIndex uint64,
 	routineInputIndex uint64,
 	lastInputTime *time.Time,
+	lastOutputTime time.Time,
 	callbackTimer *timeTracker,
 	batchTimer *timeTracker,
 ) (
 	input InputType,
+	requeueCount uint,
 	channelClosed bool,
+	retired bool,
 	forceSendBatch bool,
 	err stackerr.Error,
 ) {
@@ -47,7 +63,7 @@ func getInput[
 	// so we always exit on that. We check this first so
 	// that it has the highest priority.
 	if settings.internalCtx.Err() != nil {
-		return input, false, false, settings.ctxCancelledFunc(executorInputIndex, routineInputIndex)
+		return input, 0, false, false, false, settings.ctxCancelledFunc(executorInputIndex, routineInputIndex)
 	} else {
 		// The internal context is not done, so now wait for
 		// the first thing to act on.
@@ -57,48 +73,401 @@ func getInput[
 		if batchTimer.TimerChan() != nil {
 			select {
 			case <-batchTimer.TimerChan():
-				return input, false, true, nil
+				return input, 0, false, false, true, nil
 			default:
 			}
 		}
 
+		queue := settings.requeueQueue
+
+		// If items are being tracked through the chain, we can only receive from the
+		// input channel while holding the edge's receive token, so that the lineages
+		// are taken off the edge in the same order as the items.
+		edge := settings.inputEdge
+		holdingRecvToken := false
+		if edge != nil {
+			defer func() {
+				if holdingRecvToken {
+					edge.releaseRecv()
+				}
+			}()
+		}
+		resetCallbackTimer := true
+		// Whether the callback timer was reset for the current wait
+		callbackTimerReset := false
+
+		// A token has to be reserved from the rate limiter before taking an input. While
+		// waiting for the token, the routine doesn't read from the input channel, but it
+		// still watches for everything else.
+		limiter := settings.rateLimiter
+		tokenReserved := false
+		tokenUsed := false
+		var tokenReadyAt time.Time
+		var tokenTimer *time.Timer
+		var limitChanged <-chan struct{}
+		defer func() {
+			if tokenTimer != nil {
+				tokenTimer.Stop()
+			}
+			// If no input was taken, the token wasn't used
+			if tokenReserved && !tokenUsed {
+				limiter.refund()
+			}
+		}()
+
+		// The routine has usually just stored an output, so the time it did
+		// that is when it started waiting for an input.
+		settings.routineStatusTracker.updateRoutineStatusAt(settings.state, AwaitingInput, lastOutputTime)
+
 		// We need a loop because a timeout will need to retry after running the callback.
 		for {
 
-			// Reset the callback timer, if there is one
-			callbackTimer.Reset()
+			// Get the channel for retirements before checking for one, so
+			// that we can't miss one that happens in between.
+			retirementChanged := settings.scaler.retirementChanged()
+			// The routine is idle, so this is when it can retire if there
+			// are more routines than the executor should have. It doesn't
+			// retire while there are requeued inputs, since the routines
+			// only watch the requeue queue while there's something in it.
+			if queue.Pending() == 0 && settings.scaler.shouldRetire() {
+				return input, 0, false, true, false, nil
+			}
 
-			select {
-			// Check if the internal executor context is done
-			case <-settings.internalCtx.Done():
-				// If so, exit
-				return input, false, false, settings.ctxCancelledFunc(executorInputIndex, routineInputIndex)
-
-			// Try to get an input from the input channel
-			case input, inputReceived = <-settings.inputChan:
-				// If the channel is closed, exit out of the routine
-				if !inputReceived {
-					return input, true, false, nil
+			// Once the chain is drained, no new inputs are taken from the input channel,
+			// but the inputs that were requeued are still processed. With fair queuing,
+			// the dispatcher stops taking inputs instead, and still hands out the ones
+			// it has queued.
+			draining := isClosed(settings.drained)
+			if draining && settings.fairChan == nil {
+				queue.SetInputChanClosed()
+			}
+			drainedChan := settings.drained
+			if draining {
+				drainedChan = nil
+			}
+
+			// If the executor is paused, wait until it's resumed before taking an input.
+			// Draining overrides pausing, so that the chain can finish.
+			paused, pauseChanged := settings.pauser.isPaused()
+			if paused && !draining {
+				// Don't hold on to anything that other routines (or other executors) could
+				// use in the meantime. It's reserved again once the executor is resumed.
+				if tokenTimer != nil {
+					tokenTimer.Stop()
+					tokenTimer = nil
 				}
-				// Update the last input timestamp
-				*lastInputTime = time.Now()
-				return input, false, false, nil
+				if tokenReserved {
+					limiter.refund()
+					tokenReserved = false
+				}
+				if holdingRecvToken {
+					edge.releaseRecv()
+					holdingRecvToken = false
+				}
+				settings.routineStatusTracker.updateRoutineStatus(settings.state, Paused)
+				select {
+				case <-settings.internalCtx.Done():
+					return input, 0, false, false, false, settings.ctxCancelledFunc(executorInputIndex, routineInputIndex)
+				case <-pauseChanged:
+					// The callback timer is reset, so the time spent paused doesn't count
+					settings.routineStatusTracker.updateRoutineStatus(settings.state, AwaitingInput)
+				case <-retirementChanged:
+				case <-drainedChan:
+				// A partial batch can still be sent while paused
+				case <-batchTimer.TimerChan():
+					return input, 0, false, false, true, nil
+				}
+				continue
+			}
 
-			// This will trigger if there's a batch timer and it's ready
-			case <-batchTimer.TimerChan():
-				return input, false, true, nil
-
-			// This will trigger if the output channel is full for a specified
-			// amount of time AND an FullOutputChannelCallback is provided. Otherwise,
-			// it will never return.
-			case <-callbackTimer.TimerChan():
-				if err := settings.executorInput.EmptyInputChannelCallback(&EmptyInputChannelCallbackInput{
-					RoutineFunctionMetadata: settings.getRoutineFunctionMetadata(executorInputIndex, routineInputIndex),
-					TimeSinceLastInput:      time.Since(*lastInputTime),
-				}); err != nil {
-					return input, false, false, err
+			// Reserve a token, if we don't have one yet
+			if !tokenReserved {
+				var wait time.Duration
+				wait, tokenReadyAt, limitChanged = limiter.reserve()
+				tokenReserved = true
+				if wait > 0 {
+					tokenTimer = time.NewTimer(wait)
+					settings.routineStatusTracker.updateRoutineStatus(settings.state, RateLimited)
+				}
+			}
+			var tokenTimerChan <-chan time.Time
+			if tokenTimer != nil {
+				tokenTimerChan = tokenTimer.C
+			}
+
+			// Get the channel for changes to the requeue queue before checking the
+			// queue, so that we can't miss a change that happens in between. If
+			// nothing has been requeued, the only change to watch for is the input
+			// channel being closed while waiting for the rate limit, since the
+			// routine that requeues an input checks the queue again afterwards.
+			var queueChanged <-chan struct{}
+			if queue.Pending() > 0 || tokenTimerChan != nil {
+				queueChanged = queue.Changed()
+			}
+
+			// Inputs that have been requeued are taken once the inputs that were
+			// waiting ahead of them have been received
+			if tokenTimerChan == nil {
+				if entry, ok := queue.Pop(); ok {
+					*lastInputTime = time.Now()
+					if entry.keyBucket != nil {
+						settings.keyedRateLimiter.takeBack(entry.keyBucket)
+					} else if deferred, err := settings.deferForKey(entry, executorInputIndex, routineInputIndex); err != nil {
+						return input, 0, false, false, false, err
+					} else if deferred {
+						// Take a new token for the next input, since this one won't be processed yet
+						limiter.refund()
+						tokenReserved = false
+						continue
+					}
+					settings.item.lineage = entry.lineage
+					tokenUsed = true
+					return entry.input, entry.requeueCount, false, false, false, settings.checkRateLimitToken(tokenReadyAt, executorInputIndex, routineInputIndex)
+				}
+			}
+
+			inputChan := settings.inputChan
+			fairChan := settings.fairChan
+			var recvToken <-chan struct{}
+			if edge != nil && !holdingRecvToken {
+				// Wait for the receive token before receiving from the channel
+				recvToken = edge.recvToken
+				inputChan = nil
+			}
+			if tokenTimerChan != nil {
+				// Wait for the rate limit before receiving from the channel
+				recvToken = nil
+				inputChan = nil
+				fairChan = nil
+			}
+			if queue.IsInputChanClosed() {
+				// If the input channel is closed and there's nothing left that
+				// could be requeued, there's nothing left to do.
+				if queue.Pending() == 0 {
+					return input, 0, true, false, false, nil
+				}
+				// Otherwise, stop reading from the closed channel and wait
+				// for the requeued inputs.
+				inputChan = nil
+				fairChan = nil
+				recvToken = nil
+			}
+
+			// If an input is already waiting in the input channel, take it without
+			// waiting for anything else, since everything else was just checked.
+			received := false
+			waited := false
+			if len(inputChan) > 0 {
+				select {
+				case input, inputReceived = <-inputChan:
+					received = true
+				default:
 				}
 			}
+
+			// Reset the callback timer, if there is one. If an input is already
+			// waiting, the routine won't have to wait, so it's left alone.
+			if !received && resetCallbackTimer {
+				callbackTimerReset = len(inputChan) == 0 && len(fairChan) == 0
+				if callbackTimerReset {
+					callbackTimer.Reset()
+				}
+			}
+			resetCallbackTimer = true
+
+			if !received {
+				waited = true
+				select {
+				// Check if the internal executor context is done
+				case <-settings.internalCtx.Done():
+					// If so, exit
+					return input, 0, false, false, false, settings.ctxCancelledFunc(executorInputIndex, routineInputIndex)
+
+				// The reserved rate limit token can now be used
+				case <-tokenTimerChan:
+					tokenTimer = nil
+					settings.routineStatusTracker.updateRoutineStatus(settings.state, AwaitingInput)
+					resetCallbackTimer = false
+					continue
+
+				// The rate limit changed, so reserve a new token under the new limit
+				case <-limitChanged:
+					if tokenTimer != nil {
+						tokenTimer.Stop()
+						tokenTimer = nil
+					}
+					limiter.refund()
+					tokenReserved = false
+					// Don't block the other routines from receiving while waiting for the new token
+					if holdingRecvToken {
+						edge.releaseRecv()
+						holdingRecvToken = false
+					}
+					resetCallbackTimer = false
+					continue
+
+				// The chain is being drained, so stop taking new inputs
+				case <-drainedChan:
+					resetCallbackTimer = false
+					continue
+
+				// More routines have to retire, so check whether this one should
+				case <-retirementChanged:
+					resetCallbackTimer = false
+					continue
+
+				// We got the receive token, so now we can wait for an input
+				case <-recvToken:
+					holdingRecvToken = true
+					resetCallbackTimer = false
+					continue
+
+				// Try to get an input from the input channel
+				case input, inputReceived = <-inputChan:
+					received = true
+
+				// Try to get an input from the fair queue
+				case entry, ok := <-fairChan:
+					// If the fair queue is closed, the input channel is closed
+					// and everything in the fair queue has been taken.
+					if !ok {
+						queue.SetInputChanClosed()
+						continue
+					}
+					*lastInputTime = time.Now()
+					queue.Received()
+					if deferred, err := settings.deferForKey(entry, executorInputIndex, routineInputIndex); err != nil {
+						return input, 0, false, false, false, err
+					} else if deferred {
+						// Take a new token for the next input, since this one won't be processed yet
+						limiter.refund()
+						tokenReserved = false
+						resetCallbackTimer = false
+						continue
+					}
+					settings.item.lineage = entry.lineage
+					tokenUsed = true
+					return entry.input, 0, false, false, false, settings.checkRateLimitToken(tokenReadyAt, executorInputIndex, routineInputIndex)
+
+				// Something was added to or taken from the requeue queue,
+				// so check it again.
+				case <-queueChanged:
+					continue
+
+				// This will trigger if there's a batch timer and it's ready
+				case <-batchTimer.TimerChan():
+					return input, 0, false, false, true, nil
+
+				// This will trigger if the output channel is full for a specified
+				// amount of time AND an FullOutputChannelCallback is provided. Otherwise,
+				// it will never return.
+				case <-callbackTimer.TimerChan():
+					// The timer wasn't reset because an input was waiting, but
+					// another routine took it first, so reset it and wait again.
+					if !callbackTimerReset {
+						continue
+					}
+					if err := settings.executorInput.EmptyInputChannelCallback(&EmptyInputChannelCallbackInput{
+						RoutineFunctionMetadata: settings.getRoutineFunctionMetadata(executorInputIndex, routineInputIndex),
+						TimeSinceLastInput:      time.Since(*lastInputTime),
+					}); err != nil {
+						return input, 0, false, false, false, err
+					}
+				}
+			}
+			if !received {
+				continue
+			}
+
+			// If the channel is closed, exit out of the routine,
+			// unless there are requeued inputs still to process.
+			if !inputReceived {
+				queue.SetInputChanClosed()
+				continue
+			}
+			// Update the last input timestamp. If the input was already waiting, the
+			// routine got it as soon as it started waiting, so that time is used
+			// instead of reading the clock again.
+			if waited {
+				*lastInputTime = time.Now()
+			} else {
+				*lastInputTime = settings.state.since(AwaitingInput)
+			}
+			queue.Received()
+			if edge != nil {
+				// Take the input's lineage off the edge. Once it's off, other
+				// routines can receive, even if this one still has to wait for
+				// the rate limit.
+				settings.item.lineage = edge.pop()
+				edge.releaseRecv()
+				holdingRecvToken = false
+			} else if settings.createRoots {
+				// This is the first tracked executor, so the input starts a new lineage
+				settings.item.lineage = settings.itemTracker.newRoot()
+			}
+			if deferred, err := settings.deferForKey(requeuedInput[InputType]{
+				input:   input,
+				lineage: settings.item.lineage,
+			}, executorInputIndex, routineInputIndex); err != nil {
+				return input, 0, false, false, false, err
+			} else if deferred {
+				// Take a new token for the next input, since this one won't be processed yet
+				limiter.refund()
+				tokenReserved = false
+				resetCallbackTimer = false
+				continue
+			}
+			tokenUsed = true
+			return input, 0, false, false, false, settings.checkRateLimitToken(tokenReadyAt, executorInputIndex, routineInputIndex)
 		}
 	}
 }
+
+// checkRateLimitToken checks whether the rate limit token that was reserved before
+// taking an input is still valid. If the routine had to wait for the input for long
+// enough that the token would have been given back to the rate limiter in the meantime,
+// it waits for a new one.
+func (settings *getInputSettings[InputType, OutputType, OutputChanType, ProcessingFuncType]) checkRateLimitToken(tokenReadyAt time.Time, executorInputIndex uint64, routineInputIndex uint64) stackerr.Error {
+	if !settings.rateLimiter.overflowedSince(tokenReadyAt) {
+		return nil
+	}
+	if _, ok := settings.rateLimiter.wait(settings.internalCtx, func() {
+		settings.routineStatusTracker.updateRoutineStatus(settings.state, RateLimited)
+	}); !ok {
+		return settings.ctxCancelledFunc(executorInputIndex, routineInputIndex)
+	}
+	return nil
+}
+
+// deferForKey checks the keyed rate limit for an input. If the input's key is over
+// its limit, the input is put into the requeue queue until the key's limit allows
+// it, so that the routine can take an input with another key in the meantime. If
+// the key already has too many inputs in the queue, the routine waits for the key's
+// limit instead, so that inputs back up in the input channel.
+func (settings *getInputSettings[InputType, OutputType, OutputChanType, ProcessingFuncType]) deferForKey(entry requeuedInput[InputType], executorInputIndex uint64, routineInputIndex uint64) (deferred bool, err stackerr.Error) {
+	if settings.keyedRateLimiter == nil {
+		return false, nil
+	}
+	wait, kb := settings.keyedRateLimiter.reserve(entry.input)
+	if wait <= 0 {
+		return false, nil
+	}
+	if settings.keyedRateLimiter.setAside(kb) {
+		// The token has been reserved, so the input can be processed
+		// as soon as it comes back out of the queue.
+		entry.keyBucket = kb
+		settings.requeueQueue.Push(entry, wait)
+		settings.item.lineage = nil
+		return true, nil
+	}
+	settings.item.lineage = entry.lineage
+	settings.routineStatusTracker.updateRoutineStatus(settings.state, RateLimited)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-settings.internalCtx.Done():
+		return false, settings.ctxCancelledFunc(executorInputIndex, routineInputIndex)
+	case <-timer.C:
+		return false, nil
+	}
+}
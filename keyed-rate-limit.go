@@ -0,0 +1,118 @@
+package concurrency
+
+import (
+	"sync"
+	"time"
+)
+
+// KeyedRateLimit is a separate token bucket limit for each key of the inputs
+// of an executor, so that inputs with one key can't use up the limit of the others.
+type KeyedRateLimit[InputType any] struct {
+	// REQUIRED. A function that gets the key of an input.
+	Key func(input InputType) string
+	// REQUIRED. The limit for each key.
+	Limit RateLimit
+	// OPTIONAL. How long a key can go without any inputs before it's forgotten.
+	// A key is only forgotten once its limit has fully recovered, so forgetting
+	// it never allows more inputs than the limit. Defaults to the
+	// DefaultKeyedRateLimitIdleTimeout value.
+	IdleTimeout time.Duration
+	// OPTIONAL. The maximum number of inputs of a single key that can be set aside
+	// while they wait for the key's limit. Once a key has this many inputs set aside,
+	// a routine that takes another input with that key waits for the key's limit
+	// instead, so that a single busy key can't fill up memory with inputs that are
+	// waiting. If less than 0, inputs are never set aside. Defaults to the
+	// DefaultKeyedRateLimitMaxDeferred value.
+	MaxDeferred int
+}
+
+type keyedBucket struct {
+	bucket   *tokenBucket
+	lastUsed time.Time
+	// The number of inputs with this key that are currently set aside
+	deferred int
+}
+
+type keyedRateLimiter[InputType any] struct {
+	key         func(input InputType) string
+	limit       RateLimit
+	idleTimeout time.Duration
+	maxDeferred int
+	lock        sync.Mutex
+	buckets     map[string]*keyedBucket
+	lastEvicted time.Time
+}
+
+func newKeyedRateLimiter[InputType any](limit KeyedRateLimit[InputType]) *keyedRateLimiter[InputType] {
+	if limit.Key == nil {
+		return nil
+	}
+	return &keyedRateLimiter[InputType]{
+		key:         limit.Key,
+		limit:       limit.Limit,
+		idleTimeout: zeroDefault(limit.IdleTimeout, DefaultKeyedRateLimitIdleTimeout),
+		maxDeferred: zeroDefault(limit.MaxDeferred, DefaultKeyedRateLimitMaxDeferred),
+		buckets:     map[string]*keyedBucket{},
+		lastEvicted: time.Now(),
+	}
+}
+
+// reserve takes a token for the key of the input, and returns how long
+// the caller needs to wait before it can use it, along with the key's bucket.
+func (kl *keyedRateLimiter[InputType]) reserve(input InputType) (time.Duration, *keyedBucket) {
+	key := kl.key(input)
+	now := time.Now()
+	kl.lock.Lock()
+	kb, ok := kl.buckets[key]
+	if !ok {
+		kb = &keyedBucket{
+			bucket: newTokenBucket(kl.limit),
+		}
+		kl.buckets[key] = kb
+	}
+	kb.lastUsed = now
+	if now.Sub(kl.lastEvicted) >= kl.idleTimeout {
+		kl.evict(now)
+	}
+	kl.lock.Unlock()
+	wait, _, _ := kb.bucket.reserve()
+	return wait, kb
+}
+
+// setAside counts an input of the bucket's key as set aside, and returns false
+// if the key already has as many inputs set aside as it's allowed to.
+func (kl *keyedRateLimiter[InputType]) setAside(kb *keyedBucket) bool {
+	kl.lock.Lock()
+	defer kl.lock.Unlock()
+	if kb.deferred >= kl.maxDeferred {
+		return false
+	}
+	kb.deferred++
+	return true
+}
+
+// takeBack counts an input of the bucket's key as no longer set aside.
+func (kl *keyedRateLimiter[InputType]) takeBack(kb *keyedBucket) {
+	kl.lock.Lock()
+	defer kl.lock.Unlock()
+	kb.deferred--
+}
+
+// evict forgets the keys that have been idle for longer than the idle timeout
+// and whose limit has fully recovered, as long as none of their inputs are
+// set aside. Must be called with the lock held.
+func (kl *keyedRateLimiter[InputType]) evict(now time.Time) {
+	kl.lastEvicted = now
+	for key, kb := range kl.buckets {
+		if now.Sub(kb.lastUsed) >= kl.idleTimeout && kb.deferred == 0 && kb.bucket.isFull() {
+			delete(kl.buckets, key)
+		}
+	}
+}
+
+// numKeys returns the number of keys that are currently being tracked.
+func (kl *keyedRateLimiter[InputType]) numKeys() int {
+	kl.lock.Lock()
+	defer kl.lock.Unlock()
+	return len(kl.buckets)
+}
@@ -0,0 +1,119 @@
+package concurrency
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Limiter caps the total cost of the processing function calls that are in
+// flight across every executor it's attached to, for executors (possibly in
+// unrelated chains) that share a downstream resource. Each call takes its cost
+// from the limiter before it starts and gives it back when it returns.
+type Limiter struct {
+	capacity int64
+	sem      *semaphore.Weighted
+	// The total cost of the calls that are currently in flight
+	inFlight int64
+	// The number of calls that have taken their cost from the limiter
+	numAcquired uint64
+	// The number of calls that had to wait for the limiter
+	numWaited uint64
+	// The total and the longest time that calls have waited, in nanoseconds
+	totalWait int64
+	maxWait   int64
+}
+
+// NewLimiter creates a Limiter that allows calls with a total cost of up to
+// capacity to be in flight at once. A capacity of less than 1 is treated as 1.
+func NewLimiter(capacity int64) *Limiter {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Limiter{
+		capacity: capacity,
+		sem:      semaphore.NewWeighted(capacity),
+	}
+}
+
+// clampCost limits a cost to what the limiter can ever hand out, so that a
+// call with a cost over the capacity waits for the whole limiter instead of
+// waiting forever.
+func (l *Limiter) clampCost(cost int64) int64 {
+	if cost > l.capacity {
+		return l.capacity
+	}
+	if cost < 0 {
+		return 0
+	}
+	return cost
+}
+
+// acquire takes the cost from the limiter, waiting until it's available or the
+// context is done. The onWait function is called before waiting, if the cost
+// isn't available right away. Returns how long it waited.
+func (l *Limiter) acquire(ctx context.Context, cost int64, onWait func()) (waited time.Duration, err error) {
+	if cost == 0 {
+		return 0, nil
+	}
+	if !l.sem.TryAcquire(cost) {
+		onWait()
+		start := time.Now()
+		if err := l.sem.Acquire(ctx, cost); err != nil {
+			return time.Since(start), err
+		}
+		waited = time.Since(start)
+		atomic.AddUint64(&l.numWaited, 1)
+		atomic.AddInt64(&l.totalWait, int64(waited))
+		for {
+			prev := atomic.LoadInt64(&l.maxWait)
+			if int64(waited) <= prev || atomic.CompareAndSwapInt64(&l.maxWait, prev, int64(waited)) {
+				break
+			}
+		}
+	}
+	atomic.AddUint64(&l.numAcquired, 1)
+	atomic.AddInt64(&l.inFlight, cost)
+	return waited, nil
+}
+
+// release gives the cost of a finished call back to the limiter.
+func (l *Limiter) release(cost int64) {
+	if cost == 0 {
+		return
+	}
+	atomic.AddInt64(&l.inFlight, -cost)
+	l.sem.Release(cost)
+}
+
+// GetCapacity returns the maximum total cost of the calls that can be in flight at once.
+func (l *Limiter) GetCapacity() int64 {
+	return l.capacity
+}
+
+// GetInFlight returns the total cost of the calls that are currently in flight.
+func (l *Limiter) GetInFlight() int64 {
+	return atomic.LoadInt64(&l.inFlight)
+}
+
+// GetNumAcquired returns the number of calls that have taken their cost from the limiter.
+func (l *Limiter) GetNumAcquired() uint64 {
+	return atomic.LoadUint64(&l.numAcquired)
+}
+
+// GetNumWaited returns the number of calls that had to wait for the limiter.
+func (l *Limiter) GetNumWaited() uint64 {
+	return atomic.LoadUint64(&l.numWaited)
+}
+
+// GetTotalWaitTime returns the total time that calls have waited for the limiter.
+func (l *Limiter) GetTotalWaitTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.totalWait))
+}
+
+// GetMaxWaitTime returns the longest time that a call has waited for the limiter.
+func (l *Limiter) GetMaxWaitTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.maxWait))
+}
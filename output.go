@@ -22,6 +22,10 @@ type saveOutputSettings[
 	outputIndexCounter                *uint64
 	getRoutineFunctionMetadata        func(executorInputIndex uint64, routineInputIdx uint64) *RoutineFunctionMetadata
 	batchTimeTracker                  *timeTracker
+	outputEdge                        *trackedEdge
+	item                              *trackedItem
+	routineStatusTracker              *RoutineStatusTracker
+	state                             *routineState
 }
 
 func saveOutput[OutputChanType any](
@@ -58,38 +62,101 @@ func saveOutput[OutputChanType any](
 		// Get the index of this output insert attempt
 		outputIndex := atomic.AddUint64(settings.outputIndexCounter, 1) - 1
 
-		for {
+		// If items are being tracked through the chain, we can only send into the
+		// output channel while holding the edge's send token, so that the lineages
+		// are put onto the edge in the same order as the items.
+		if settings.outputEdge != nil {
+			select {
+			case <-settings.internalCtx.Done():
+				return settings.ctxCancelledFunc(executorInputIndex, routineInputIndex)
+			case <-settings.outputEdge.sendToken:
+			}
+			defer settings.outputEdge.releaseSend()
+			// Put the lineage onto the edge before sending, so that it's there
+			// before a downstream routine can receive the item.
+			settings.outputEdge.push(settings.item.lineage)
+			err = saveOutputLoop(settings, value, executorInputIndex, routineInputIndex, outputIndex, lastOutput, callbackTracker)
+			if err != nil {
+				// It didn't get sent, so take the lineage back off the edge
+				settings.outputEdge.unpush()
+			}
+			return err
+		}
 
-			// Reset the callback timer, if there is one
+		return saveOutputLoop(settings, value, executorInputIndex, routineInputIndex, outputIndex, lastOutput, callbackTracker)
+	}
+}
+
+// saveOutputLoop waits until the value can be put into the output channel.
+func saveOutputLoop[OutputChanType any](
+	settings *saveOutputSettings[OutputChanType],
+	value OutputChanType,
+	executorInputIndex uint64,
+	routineInputIndex uint64,
+	outputIndex uint64,
+	lastOutput *time.Time,
+	callbackTracker *timeTracker,
+) (
+	err stackerr.Error,
+) {
+	// If there's room in the output channel, put the value into it without waiting
+	// for anything else. The routine started waiting to output when the processing
+	// function finished, just before this, so that time is used as the time of the
+	// output instead of reading the clock again.
+	if len(settings.outputChan) < cap(settings.outputChan) {
+		select {
+		case settings.outputChan <- value:
+			*lastOutput = settings.state.since(AwaitingOutput)
+			settings.routineStatusTracker.addOutput(*lastOutput)
+			settings.batchTimeTracker.Reset()
+			return nil
+		default:
+		}
+	}
+
+	// Whether the callback timer was reset for the current wait
+	callbackTimerReset := false
+	for {
+
+		// Reset the callback timer, if there is one. If there's room in the output
+		// channel, the routine won't have to wait, so it's left alone.
+		callbackTimerReset = len(settings.outputChan) == cap(settings.outputChan)
+		if callbackTimerReset {
 			callbackTracker.Reset()
+		}
 
-			select {
+		select {
 
-			// This will get a value from contextDoneChan when the context is cancelled.
-			case <-settings.internalCtx.Done():
-				return settings.ctxCancelledFunc(executorInputIndex, routineInputIndex)
+		// This will get a value from contextDoneChan when the context is cancelled.
+		case <-settings.internalCtx.Done():
+			return settings.ctxCancelledFunc(executorInputIndex, routineInputIndex)
 
-			// Try to put the result in the output channel
-			case settings.outputChan <- value:
-				// The insert into the output channel succeeded
-				// Update the last output timestamp
-				*lastOutput = time.Now()
+		// Try to put the result in the output channel
+		case settings.outputChan <- value:
+			// The insert into the output channel succeeded
+			// Update the last output timestamp
+			*lastOutput = time.Now()
+			settings.routineStatusTracker.addOutput(*lastOutput)
 
-				// If there's a batch output tracker, update it
-				settings.batchTimeTracker.Reset()
-				return nil
+			// If there's a batch output tracker, update it
+			settings.batchTimeTracker.Reset()
+			return nil
 
-			// This will trigger if the output channel is full for a specified
-			// amount of time AND an FullOutputChannelCallback is provided. Otherwise,
-			// it will never return.
-			case <-callbackTracker.TimerChan():
-				if err := settings.fullOutputChannelCallback(&FullOutputChannelCallbackInput{
-					RoutineFunctionMetadata: settings.getRoutineFunctionMetadata(executorInputIndex, routineInputIndex),
-					TimeSinceLastOutput:     time.Since(*lastOutput),
-					OutputIndex:             outputIndex,
-				}); err != nil {
-					return err
-				}
+		// This will trigger if the output channel is full for a specified
+		// amount of time AND an FullOutputChannelCallback is provided. Otherwise,
+		// it will never return.
+		case <-callbackTracker.TimerChan():
+			// The timer wasn't reset because there was room in the output channel,
+			// but another routine took it first, so reset it and wait again.
+			if !callbackTimerReset {
+				continue
+			}
+			if err := settings.fullOutputChannelCallback(&FullOutputChannelCallbackInput{
+				RoutineFunctionMetadata: settings.getRoutineFunctionMetadata(executorInputIndex, routineInputIndex),
+				TimeSinceLastOutput:     time.Since(*lastOutput),
+				OutputIndex:             outputIndex,
+			}); err != nil {
+				return err
 			}
 		}
 	}
@@ -136,6 +203,7 @@ func getSaveOutputBatchFunc[OutputType any](batchSize int) func(
 	batch := make([]OutputType, batchSize)
 	var batchIdx int = 0
 	var batchLock sync.Mutex
+	lineages := &batchLineages{}
 
 	return func(
 		settings *saveOutputSettings[[]OutputType],
@@ -156,20 +224,22 @@ func getSaveOutputBatchFunc[OutputType any](batchSize int) func(
 		if !forceSendBatch && (!settings.ignoreZeroValueOutputs || !reflect.ValueOf(value).IsZero()) {
 			batch[batchIdx] = value
 			batchIdx++
+			lineages.add(settings.outputEdge, settings.item.lineage)
 		}
 
 		// If we're force-sending a batch, or the batch is full, output it
 		if (forceSendBatch && batchIdx > 0) || batchIdx == batchSize {
 			// Save the output
-			if batchIdx == batchSize {
-				// If it's a complete batch, send the entire slice
-				err = saveOutput(settings, batch, executorInputIndex, routineInputIndex, lastOutput, callbackTracker, false)
-			} else {
+			err = lineages.send(settings.outputEdge, settings.item, func() stackerr.Error {
+				if batchIdx == batchSize {
+					// If it's a complete batch, send the entire slice
+					return saveOutput(settings, batch, executorInputIndex, routineInputIndex, lastOutput, callbackTracker, false)
+				}
 				// If it's an incomplete batch, send a subslice since the slice
 				// was pre-allocated and filled with zero-values (which we don't
 				// want to send downstream)
-				err = saveOutput(settings, batch[0:batchIdx], executorInputIndex, routineInputIndex, lastOutput, callbackTracker, false)
-			}
+				return saveOutput(settings, batch[0:batchIdx], executorInputIndex, routineInputIndex, lastOutput, callbackTracker, false)
+			})
 
 			// Clear the batch
 			batch = make([]OutputType, batchSize)
@@ -200,6 +270,7 @@ func getSaveOutputRebatchFunc[OutputType any](batchSize int) func(
 	batch := make([]OutputType, batchSize)
 	var batchIdx int = 0
 	var batchLock sync.Mutex
+	lineages := &batchLineages{}
 
 	return func(
 		settings *saveOutputSettings[[]OutputType],
@@ -218,15 +289,16 @@ func getSaveOutputRebatchFunc[OutputType any](batchSize int) func(
 		// A function for sending the current batch downstream
 		sendBatchFunc := func() stackerr.Error {
 			// Save the output
-			if batchIdx == batchSize {
-				// If it's a complete batch, send the entire slice
-				err = saveOutput(settings, batch, executorInputIndex, routineInputIndex, lastOutput, callbackTracker, false)
-			} else {
+			err = lineages.send(settings.outputEdge, settings.item, func() stackerr.Error {
+				if batchIdx == batchSize {
+					// If it's a complete batch, send the entire slice
+					return saveOutput(settings, batch, executorInputIndex, routineInputIndex, lastOutput, callbackTracker, false)
+				}
 				// If it's an incomplete batch, send a subslice since the slice
 				// was pre-allocated and filled with zero-values (which we don't
 				// want to send downstream)
-				err = saveOutput(settings, batch[0:batchIdx], executorInputIndex, routineInputIndex, lastOutput, callbackTracker, false)
-			}
+				return saveOutput(settings, batch[0:batchIdx], executorInputIndex, routineInputIndex, lastOutput, callbackTracker, false)
+			})
 
 			// Clear the batch
 			batch = make([]OutputType, batchSize)
@@ -253,6 +325,7 @@ func getSaveOutputRebatchFunc[OutputType any](batchSize int) func(
 				if !settings.ignoreZeroValueOutputs || !reflect.ValueOf(value).IsZero() {
 					batch[batchIdx] = value
 					batchIdx++
+					lineages.add(settings.outputEdge, settings.item.lineage)
 
 					// Check if we now have a full batch
 					if batchIdx >= batchSize {
@@ -0,0 +1,120 @@
+package concurrency
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+// PanicAction is the decision returned by a PanicHandler for how
+// a recovered panic should be treated.
+type PanicAction int
+
+const (
+	// The panic is converted into an error and the executor fails,
+	// the same as if no PanicHandler had been provided.
+	PanicActionFail PanicAction = iota
+	// The input that caused the panic is dropped (no output is stored
+	// for it) and the routine moves on to the next input.
+	PanicActionSkip
+	// The panic is raised again, outside of the executor's recovery, with
+	// a RepanicError that has the recovered value and the original stack.
+	PanicActionRepanic
+)
+
+func (a PanicAction) String() string {
+	switch a {
+	case PanicActionFail:
+		return "Fail"
+	case PanicActionSkip:
+		return "Skip"
+	case PanicActionRepanic:
+		return "Repanic"
+	default:
+		return "Unknown"
+	}
+}
+
+// RepanicError is the value that a panic is raised again with, for the
+// PanicActionRepanic action. The stack of the original panic is lost once
+// it has been recovered, so it's kept here instead.
+type RepanicError struct {
+	// The value that was recovered from the original panic
+	Recovered any
+	// The stack at the point of the original panic
+	Stack []byte
+}
+
+func (re *RepanicError) Error() string {
+	return fmt.Sprintf("%v\n\noriginal panic stack:\n%s", re.Recovered, string(re.Stack))
+}
+
+// Unwrap returns the recovered value, if it's an error.
+func (re *RepanicError) Unwrap() error {
+	err, _ := re.Recovered.(error)
+	return err
+}
+
+// A wrapper for a recovered value that should be re-panicked, so that
+// the routine's own recovery knows not to convert it into an error.
+type repanic struct {
+	err *RepanicError
+}
+
+// panicToError converts a recovered panic value into an error that
+// includes the stack at the point of the panic.
+func panicToError(r any, stack []byte) stackerr.Error {
+	if perr, ok := r.(stackerr.Error); ok {
+		return stackerr.Errorf("%s: %s", perr.Error(), string(stack))
+	}
+	return stackerr.Errorf("%v: %s", r, string(stack))
+}
+
+// processWithPanicHandler calls the processing function and, if it panics,
+// hands the recovered value to the executor's PanicHandler to decide
+// what to do with it.
+func processWithPanicHandler[
+	InputType any,
+	OutputType any,
+	OutputChanType any,
+	ProcessingFuncType ProcessingFuncTypes[InputType, OutputType],
+](
+	settings *routineSettings[InputType, OutputType, OutputChanType, ProcessingFuncType],
+	ctx context.Context,
+	input InputType,
+	metadata *RoutineFunctionMetadata,
+) (
+	output OutputType,
+	skip bool,
+	err stackerr.Error,
+) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			action := settings.executorInput.PanicHandler(&PanicHandlerInput[InputType]{
+				RoutineFunctionMetadata: metadata,
+				Recovered:               r,
+				Stack:                   stack,
+				Input:                   input,
+			})
+			switch action {
+			case PanicActionSkip:
+				skip = true
+				err = nil
+			case PanicActionRepanic:
+				panic(&repanic{
+					err: &RepanicError{
+						Recovered: r,
+						Stack:     stack,
+					},
+				})
+			default:
+				err = panicToError(r, stack)
+			}
+		}
+	}()
+	output, err = settings.process(ctx, input, metadata)
+	return output, false, err
+}
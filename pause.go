@@ -0,0 +1,70 @@
+package concurrency
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+type pauseState struct {
+	paused bool
+	// Gets closed when the state changes
+	changed chan struct{}
+}
+
+// pauser tracks whether an executor is paused. Routines of a paused executor
+// finish the input they're processing, but don't take any more until it's resumed.
+type pauser struct {
+	lock  sync.Mutex
+	state atomic.Pointer[pauseState]
+}
+
+func newPauser() *pauser {
+	p := &pauser{}
+	p.state.Store(&pauseState{
+		changed: make(chan struct{}),
+	})
+	return p
+}
+
+// setPaused pauses or resumes the executor.
+func (p *pauser) setPaused(paused bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	previous := p.state.Load()
+	if previous.paused == paused {
+		return
+	}
+	p.state.Store(&pauseState{
+		paused:  paused,
+		changed: make(chan struct{}),
+	})
+	close(previous.changed)
+}
+
+// isPaused returns whether the executor is paused, and a channel that gets
+// closed when that changes.
+func (p *pauser) isPaused() (paused bool, changed <-chan struct{}) {
+	state := p.state.Load()
+	return state.paused, state.changed
+}
+
+// wait waits until the executor isn't paused, or until the chain is drained. The
+// onPause function is called before waiting, if it's paused. Returns false if the
+// context is done first.
+func (p *pauser) wait(ctx context.Context, drained <-chan struct{}, onPause func()) bool {
+	for {
+		paused, changed := p.isPaused()
+		if !paused {
+			return true
+		}
+		onPause()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-drained:
+			return true
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package concurrency
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit is a token bucket limit on how often the routines of an
+// executor can take an input.
+type RateLimit struct {
+	// The average number of inputs per second that can be taken. If 0
+	// or less, there is no limit.
+	Rate float64
+	// The maximum number of inputs that can be taken at once after the
+	// executor has been idle. If less than 1, 1 is used.
+	Burst int
+}
+
+// A token bucket that hands out reservations. The number of tokens can go
+// negative, in which case the caller waits until its token would be available.
+type tokenBucket struct {
+	lock sync.Mutex
+	// Whether there's currently no limit, so that the lock
+	// can be skipped when no limit is being used.
+	unlimited atomic.Bool
+	limit     RateLimit
+	tokens    float64
+	last      time.Time
+	// The last time that the bucket was full
+	lastFull time.Time
+	// A channel that gets closed (and replaced) whenever the limit
+	// changes, so that waiting routines can reserve again.
+	changed chan struct{}
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	tb := &tokenBucket{
+		changed: make(chan struct{}),
+	}
+	tb.setLimit(limit)
+	return tb
+}
+
+func (tb *tokenBucket) burst() float64 {
+	if tb.limit.Burst < 1 {
+		return 1
+	}
+	return float64(tb.limit.Burst)
+}
+
+// advance adds the tokens that have accrued since the last update. Must be
+// called with the lock held.
+func (tb *tokenBucket) advance(now time.Time) {
+	if now.After(tb.last) {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.limit.Rate
+		tb.last = now
+	}
+	if tb.tokens >= tb.burst() {
+		tb.tokens = tb.burst()
+		tb.lastFull = now
+	}
+}
+
+// setLimit changes the limit. Tokens that have already been
+// reserved are kept.
+func (tb *tokenBucket) setLimit(limit RateLimit) {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	now := time.Now()
+	if tb.limit.Rate > 0 {
+		tb.advance(now)
+	} else {
+		// There was no limit before, so start with a full bucket
+		tb.tokens = math.Inf(1)
+		tb.last = now
+	}
+	tb.limit = limit
+	tb.advance(now)
+	tb.unlimited.Store(limit.Rate <= 0)
+	close(tb.changed)
+	tb.changed = make(chan struct{})
+}
+
+// reserve takes a token, and returns how long the caller needs to wait
+// before it can use it and the time at which it can use it. It also returns
+// a channel that gets closed if the limit changes, in which case the caller
+// should refund the token and reserve a new one. If there's no limit, no
+// token is taken, and the time and channel are both zero.
+func (tb *tokenBucket) reserve() (wait time.Duration, readyAt time.Time, changed <-chan struct{}) {
+	if tb.unlimited.Load() {
+		return 0, readyAt, nil
+	}
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	// Check again now that we have the lock
+	if tb.limit.Rate <= 0 {
+		return 0, readyAt, nil
+	}
+	now := time.Now()
+	tb.advance(now)
+	tb.tokens--
+	if tb.tokens >= 0 {
+		return 0, now, tb.changed
+	}
+	wait = time.Duration(-tb.tokens / tb.limit.Rate * float64(time.Second))
+	return wait, now.Add(wait), tb.changed
+}
+
+// wait reserves a token and waits until it can be used. The onLimited function is
+// called if there's any waiting to do. Returns false if the context is done first.
+func (tb *tokenBucket) wait(ctx context.Context, onLimited func()) (readyAt time.Time, ok bool) {
+	for {
+		wait, readyAt, changed := tb.reserve()
+		if wait <= 0 {
+			return readyAt, true
+		}
+		onLimited()
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			// The token won't be used, so give it back
+			tb.refund()
+			return readyAt, false
+		case <-changed:
+			// Reserve again under the new limit
+			timer.Stop()
+			tb.refund()
+		case <-timer.C:
+			return readyAt, true
+		}
+	}
+}
+
+// refund gives back a reserved token that wasn't used.
+func (tb *tokenBucket) refund() {
+	if tb.unlimited.Load() {
+		return
+	}
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	if tb.limit.Rate <= 0 {
+		return
+	}
+	tb.advance(time.Now())
+	tb.tokens++
+	tb.advance(time.Now())
+}
+
+// overflowedSince returns whether the bucket has been full at any point after
+// the given time. If it has, a token that was reserved at that time has effectively
+// been returned to the bucket, since the bucket had more tokens than it can hold.
+func (tb *tokenBucket) overflowedSince(t time.Time) bool {
+	if tb.unlimited.Load() {
+		return false
+	}
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	if tb.limit.Rate <= 0 {
+		return false
+	}
+	tb.advance(time.Now())
+	return tb.lastFull.After(t)
+}
+
+// isFull returns whether the bucket has all of its tokens, which means
+// that no tokens are currently reserved.
+func (tb *tokenBucket) isFull() bool {
+	if tb.unlimited.Load() {
+		return true
+	}
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	tb.advance(time.Now())
+	return tb.tokens >= tb.burst()
+}
@@ -0,0 +1,215 @@
+package concurrency
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+type requeueError struct {
+	delay time.Duration
+}
+
+func (e *requeueError) Error() string {
+	return fmt.Sprintf("input requeued with a delay of %s", e.delay.String())
+}
+
+// Requeue returns an error that, when returned by a processing function, puts
+// the input back at the end of the executor's own queue once the delay has
+// passed, instead of failing the executor. It's taken again after the inputs
+// that were waiting in the input channel at that time. Processing functions
+// that don't take an input fail with an error if they return it.
+func Requeue(delay time.Duration) stackerr.Error {
+	return stackerr.Wrap(&requeueError{
+		delay: delay,
+	})
+}
+
+// isRequeue returns whether the error is (or wraps) the error from Requeue.
+func isRequeue(err error) bool {
+	if err == nil {
+		return false
+	}
+	var rqErr *requeueError
+	return errors.As(err, &rqErr)
+}
+
+type requeuedInput[InputType any] struct {
+	input        InputType
+	requeueCount uint
+	// The number of inputs that have to be received before this one can be taken
+	// again, so that it goes behind the inputs that were already waiting
+	after uint64
+	// The lineage of the input, if items are being tracked
+	lineage []uint64
+	// If the input was set aside because its key was over its limit, the key's
+	// bucket of the keyed rate limiter, in which a token has already been reserved
+	keyBucket *keyedBucket
+}
+
+// A queue of inputs that have been requeued by the processing function. An input
+// that's ready to be processed again goes behind the inputs that were waiting in
+// the input channel (or the fair queue) at that time, and routines take it once
+// those have been received.
+type requeueQueue[InputType any] struct {
+	lock sync.Mutex
+	// The inputs whose delay has passed, in the order they became ready
+	ready []requeuedInput[InputType]
+	// The number of inputs that have been requeued but not yet taken out
+	// of the queue (including those still waiting for their delay)
+	pending int64
+	// The number of inputs that have been received from the input channel (or the
+	// fair queue) while there were requeued inputs pending
+	received uint64
+	// A function that returns the number of inputs waiting to be received
+	backlog func() int
+	// The timers of the inputs that are still waiting for their delay
+	timers map[*time.Timer]struct{}
+	// Whether the executor has exited, so nothing more can be requeued
+	stopped bool
+	// Whether the input channel has been closed
+	inputChanClosed int32
+	// A channel that gets closed (and replaced) whenever the queue changes,
+	// so that waiting routines can check it again.
+	changed atomic.Value
+}
+
+func newRequeueQueue[InputType any](backlog func() int) *requeueQueue[InputType] {
+	q := &requeueQueue[InputType]{
+		backlog: backlog,
+		timers:  map[*time.Timer]struct{}{},
+	}
+	q.changed.Store(make(chan struct{}))
+	return q
+}
+
+// notify wakes up all routines that are waiting on the changed channel.
+// Must be called with the lock held.
+func (q *requeueQueue[InputType]) notify() {
+	close(q.changed.Load().(chan struct{}))
+	q.changed.Store(make(chan struct{}))
+}
+
+// Changed returns a channel that gets closed the next time the queue changes.
+func (q *requeueQueue[InputType]) Changed() <-chan struct{} {
+	return q.changed.Load().(chan struct{})
+}
+
+// add puts an input whose delay has passed at the end of the queue. Must be
+// called with the lock held.
+func (q *requeueQueue[InputType]) add(entry requeuedInput[InputType]) {
+	entry.after = q.received + uint64(q.backlog())
+	q.ready = append(q.ready, entry)
+	q.notify()
+}
+
+// Push adds an input back into the queue after the given delay. Does nothing
+// if the executor has already exited.
+func (q *requeueQueue[InputType]) Push(entry requeuedInput[InputType], delay time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.stopped {
+		return
+	}
+	atomic.AddInt64(&q.pending, 1)
+	if delay <= 0 {
+		q.add(entry)
+		return
+	}
+	// The timer can't fire before it has been saved, since that needs the lock
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		if q.stopped {
+			return
+		}
+		delete(q.timers, timer)
+		q.add(entry)
+	})
+	q.timers[timer] = struct{}{}
+}
+
+// isNextReady returns whether the input at the front of the queue can be taken,
+// which is once the inputs that were waiting ahead of it have been received (or
+// there are none left). Must be called with the lock held.
+func (q *requeueQueue[InputType]) isNextReady() bool {
+	if len(q.ready) == 0 {
+		return false
+	}
+	return q.ready[0].after <= q.received || q.IsInputChanClosed() || q.backlog() == 0
+}
+
+// Received counts an input that was received from the input channel (or the fair
+// queue), which moves the requeued inputs closer to the front of the queue.
+func (q *requeueQueue[InputType]) Received() {
+	if atomic.LoadInt64(&q.pending) == 0 {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.received++
+	if q.isNextReady() {
+		q.notify()
+	}
+}
+
+// Pop takes the input at the front of the queue, if it can be taken yet.
+func (q *requeueQueue[InputType]) Pop() (entry requeuedInput[InputType], ok bool) {
+	if atomic.LoadInt64(&q.pending) == 0 {
+		return entry, false
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.isNextReady() {
+		return entry, false
+	}
+	entry = q.ready[0]
+	// Don't hold on to the input in the backing array
+	q.ready[0] = requeuedInput[InputType]{}
+	q.ready = q.ready[1:]
+	atomic.AddInt64(&q.pending, -1)
+	// Wake up any other routines in case they're waiting for the queue to empty
+	q.notify()
+	return entry, true
+}
+
+// Stop stops the timers of the inputs that are waiting for their delay and drops
+// everything in the queue, once the executor has exited.
+func (q *requeueQueue[InputType]) Stop() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.stopped = true
+	for timer := range q.timers {
+		timer.Stop()
+	}
+	q.timers = nil
+	q.ready = nil
+	atomic.StoreInt64(&q.pending, 0)
+	q.notify()
+}
+
+// Pending returns the number of inputs that have been requeued and not yet taken back out.
+func (q *requeueQueue[InputType]) Pending() int64 {
+	return atomic.LoadInt64(&q.pending)
+}
+
+func (q *requeueQueue[InputType]) SetInputChanClosed() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if atomic.LoadInt32(&q.inputChanClosed) == 1 {
+		return
+	}
+	atomic.StoreInt32(&q.inputChanClosed, 1)
+	// Wake up the routines that aren't reading from the input
+	// channel, so that they can find out that it's closed.
+	q.notify()
+}
+
+func (q *requeueQueue[InputType]) IsInputChanClosed() bool {
+	return atomic.LoadInt32(&q.inputChanClosed) == 1
+}
@@ -0,0 +1,98 @@
+package concurrency
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+// Result is an output of a result executor. Instead of cancelling the chain, an
+// error from the processing function is sent downstream as a Result with Err set,
+// and downstream result executors pass it through without processing it.
+type Result[T any] struct {
+	// The output value. This is the zero value if Err is set.
+	Value T
+	// The error that occurred while processing the input, in this executor
+	// or in an upstream executor.
+	Err stackerr.Error
+	// The name of the executor that produced the value or the error
+	ExecutorName string
+	// The index of the input (within the executor that produced the value
+	// or the error) that produced the value or the error
+	ExecutorInputIndex uint64
+	// The input that was being processed when the error occurred. This is
+	// nil for results without an error.
+	Input any
+}
+
+// saveOutputResult wraps a successful output into a Result and saves it.
+func saveOutputResult[OutputType any](
+	settings *saveOutputSettings[Result[OutputType]],
+	value OutputType,
+	executorInputIndex uint64,
+	routineInputIndex uint64,
+	lastOutput *time.Time,
+	callbackTracker *timeTracker,
+	forceSendBatch bool,
+) (
+	err stackerr.Error,
+) {
+	// The result itself is never a zero value, so check the value it would wrap
+	if settings.ignoreZeroValueOutputs && reflect.ValueOf(value).IsZero() {
+		return nil
+	}
+	return saveOutput(settings, Result[OutputType]{
+		Value:              value,
+		ExecutorName:       settings.getRoutineFunctionMetadata(executorInputIndex, routineInputIndex).ExecutorName,
+		ExecutorInputIndex: executorInputIndex,
+	}, executorInputIndex, routineInputIndex, lastOutput, callbackTracker, forceSendBatch)
+}
+
+// newErrorResult creates a result for an error from the processing function.
+func newErrorResult[OutputType any](input any, err stackerr.Error, metadata *RoutineFunctionMetadata) Result[OutputType] {
+	return Result[OutputType]{
+		Err:                err,
+		ExecutorName:       metadata.ExecutorName,
+		ExecutorInputIndex: metadata.ExecutorInputIndex,
+		Input:              input,
+	}
+}
+
+type ExecutorResultInput[InputType any, OutputType any] executorInput[InputType, OutputType, Result[OutputType], ProcessingFuncWithInputWithOutput[InputType, OutputType]]
+
+// ExecutorResult creates a top-level executor that outputs a Result for every input,
+// whether processing it succeeded or failed.
+func ExecutorResult[InputType any, OutputType any](ctx context.Context, input ExecutorResultInput[InputType, OutputType]) *ExecutorOutput[Result[OutputType]] {
+	input.resultError = func(in InputType, err stackerr.Error, metadata *RoutineFunctionMetadata) Result[OutputType] {
+		return newErrorResult[OutputType](in, err, metadata)
+	}
+	return new(ctx, (executorInput[InputType, OutputType, Result[OutputType], ProcessingFuncWithInputWithOutput[InputType, OutputType]])(input), saveOutputResult[OutputType], 0, false)
+}
+
+// The processing function for a chained result executor receives the upstream Result. It
+// is only called for results without an error, so the value can be used directly.
+type ChainResultInput[InputType any, OutputType any] executorInput[Result[InputType], OutputType, Result[OutputType], ProcessingFuncWithInputWithOutput[Result[InputType], OutputType]]
+
+// ChainResult chains a result executor onto an executor that outputs Results. Results
+// with an error are passed through without calling the processing function, and errors
+// from the processing function are output as Results instead of cancelling the chain.
+func ChainResult[InputType any, OutputType any](upstream *ExecutorOutput[Result[InputType]], input ChainResultInput[InputType, OutputType]) *ExecutorOutput[Result[OutputType]] {
+	input.upstream = upstream
+	input.resultPassthrough = func(in Result[InputType]) (Result[OutputType], bool) {
+		if in.Err == nil {
+			return Result[OutputType]{}, false
+		}
+		return Result[OutputType]{
+			Err:                in.Err,
+			ExecutorName:       in.ExecutorName,
+			ExecutorInputIndex: in.ExecutorInputIndex,
+			Input:              in.Input,
+		}, true
+	}
+	input.resultError = func(in Result[InputType], err stackerr.Error, metadata *RoutineFunctionMetadata) Result[OutputType] {
+		return newErrorResult[OutputType](in.Value, err, metadata)
+	}
+	return new(upstream.Ctx(), (executorInput[Result[InputType], OutputType, Result[OutputType], ProcessingFuncWithInputWithOutput[Result[InputType], OutputType]])(input), saveOutputResult[OutputType], 0, false)
+}
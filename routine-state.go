@@ -0,0 +1,158 @@
+package concurrency
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// The status of a routine that hasn't been given one yet
+const noStatus routineStatus = -1
+
+// routineState is the live state of a single routine of an executor.
+type routineState struct {
+	// The index of the routine
+	routineIdx uint
+	// The status of the routine (a routineStatus)
+	status int32
+	// When the routine entered its status, in Unix nanoseconds
+	statusSince int64
+	// The executor input index of the input the routine is working on (or waiting for)
+	inputIndex uint64
+	// The number of inputs the processing function has finished in this routine
+	numProcessed uint64
+	// The last error of the processing function in this routine
+	lastError atomic.Pointer[routineError]
+	// The heartbeats of the routine's current call of the processing function
+	heartbeat routineHeartbeat
+	// The time, in nanoseconds, that the routine has spent in each status (not
+	// counting its current status)
+	timeInStatus [numRoutineStatuses]int64
+}
+
+// A wrapper for an error, so that errors of different types can be stored atomically
+type routineError struct {
+	err error
+}
+
+func newRoutineState(tracker *RoutineStatusTracker, routineIdx uint) *routineState {
+	return &routineState{
+		routineIdx:  routineIdx,
+		status:      int32(noStatus),
+		statusSince: time.Now().UnixNano(),
+		heartbeat: routineHeartbeat{
+			tracker: tracker,
+		},
+	}
+}
+
+func (rs *routineState) getStatus() routineStatus {
+	return routineStatus(atomic.LoadInt32(&rs.status))
+}
+
+// since returns when the routine entered the status, or the current time if it
+// isn't in that status.
+func (rs *routineState) since(status routineStatus) time.Time {
+	if rs.getStatus() != status {
+		return time.Now()
+	}
+	return time.Unix(0, atomic.LoadInt64(&rs.statusSince))
+}
+
+// RoutineSnapshot is the state of a routine at the time of the snapshot.
+type RoutineSnapshot struct {
+	// The index of the routine
+	RoutineIndex uint
+	// The status of the routine
+	Status routineStatus
+	// When the routine entered its status
+	StatusSince time.Time
+	// The executor input index of the input the routine is working on (or waiting for)
+	ExecutorInputIndex uint64
+	// The number of inputs the processing function has finished in this routine,
+	// successfully or not
+	NumProcessed uint64
+	// The last error that the processing function returned (or panicked with) in
+	// this routine, or nil if there hasn't been one
+	LastError error
+	// The last heartbeat of the routine's current call of the processing function,
+	// or nil if it hasn't sent one
+	Heartbeat *Heartbeat
+	// How the time of the routine has been spent so far
+	Utilization *Utilization
+}
+
+// getRoutineState returns the state of the routine with the given index, creating
+// it if it doesn't exist yet.
+func (rst *RoutineStatusTracker) getRoutineState(routineIdx uint) *routineState {
+	if state, ok := rst.routineStates.Load(routineIdx); ok {
+		return state.(*routineState)
+	}
+	state, _ := rst.routineStates.LoadOrStore(routineIdx, newRoutineState(rst, routineIdx))
+	return state.(*routineState)
+}
+
+// snapshot returns the state of the routine at the given time.
+func (rs *routineState) snapshot(status routineStatus, now time.Time) RoutineSnapshot {
+	routine := RoutineSnapshot{
+		RoutineIndex:       rs.routineIdx,
+		Status:             status,
+		StatusSince:        time.Unix(0, atomic.LoadInt64(&rs.statusSince)),
+		ExecutorInputIndex: atomic.LoadUint64(&rs.inputIndex),
+		NumProcessed:       atomic.LoadUint64(&rs.numProcessed),
+		Utilization:        newUtilization(rs.getTimeInStatus(now)),
+	}
+	if lastError := rs.lastError.Load(); lastError != nil {
+		routine.LastError = lastError.err
+	}
+	if heartbeat, ok := rs.heartbeat.get(); ok {
+		routine.Heartbeat = &heartbeat
+	}
+	return routine
+}
+
+// removeRoutineState forgets the state of a routine that has exited, after adding
+// the time it spent in each status to the totals of the routines that have exited.
+// A snapshot of its final state is kept, unless too many routines have exited.
+func (rst *RoutineStatusTracker) removeRoutineState(state *routineState) {
+	rst.exitedLock.Lock()
+	defer rst.exitedLock.Unlock()
+	for status := range state.timeInStatus {
+		rst.timeInStatus[status] += atomic.LoadInt64(&state.timeInStatus[status])
+	}
+	if rst.maxExitedRoutines > 0 {
+		rst.exitedRoutines = append(rst.exitedRoutines, state.snapshot(state.getStatus(), time.Now()))
+		if len(rst.exitedRoutines) > rst.maxExitedRoutines {
+			rst.exitedRoutines[0] = RoutineSnapshot{}
+			rst.exitedRoutines = rst.exitedRoutines[1:]
+		}
+	}
+	rst.routineStates.Delete(state.routineIdx)
+}
+
+// Routines returns a snapshot of the state of each routine of the executor, in order
+// of their index. Routines that have exited are included with their final state, up
+// to the executor's MaxExitedRoutines most recent ones. If a routine index was used
+// again after its routine exited, the routine that exited comes first.
+func (rst *RoutineStatusTracker) Routines() []RoutineSnapshot {
+	// Hold the lock, so that a routine that exits during the snapshot
+	// isn't listed twice or left out.
+	rst.exitedLock.RLock()
+	defer rst.exitedLock.RUnlock()
+	routines := append([]RoutineSnapshot{}, rst.exitedRoutines...)
+	now := time.Now()
+	rst.routineStates.Range(func(key, value any) bool {
+		state := value.(*routineState)
+		status := state.getStatus()
+		if status == noStatus {
+			// The routine hasn't started yet
+			return true
+		}
+		routines = append(routines, state.snapshot(status, now))
+		return true
+	})
+	sort.SliceStable(routines, func(i, j int) bool {
+		return routines[i].RoutineIndex < routines[j].RoutineIndex
+	})
+	return routines
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"runtime/debug"
+	"runtime/pprof"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,12 +19,37 @@ type routineExitSettings[
 	ProcessingFuncType ProcessingFuncTypes[InputType, OutputType],
 ] struct {
 	executorInput             *executorInput[InputType, OutputType, OutputChanType, ProcessingFuncType]
+	internalCtx               context.Context
 	upstreamCtxCancel         *upstreamCtxCancel
-	passthroughCtxCancel      context.CancelFunc
+	passthroughCtxCancel      context.CancelCauseFunc
 	errChan                   chan struct{}
+	finished                  chan struct{}
 	routineStatusTracker      *RoutineStatusTracker
 	outputChan                chan OutputChanType
 	baseExecutorCallbackInput *BaseExecutorCallbackInput
+	itemTracker               *itemTracker
+	upstreamErrorDrain        *upstreamErrorDrain
+	requeueQueue              *requeueQueue[InputType]
+	// The first error that ended the executor
+	exitErrLock sync.Mutex
+	exitErr     stackerr.Error
+}
+
+// setExitErr saves the error as the executor's exit error, unless it already has one.
+func (s *routineExitSettings[InputType, OutputType, OutputChanType, ProcessingFuncType]) setExitErr(err stackerr.Error) {
+	s.exitErrLock.Lock()
+	defer s.exitErrLock.Unlock()
+	if s.exitErr == nil {
+		s.exitErr = err
+	}
+}
+
+// fail ends the executor with the error, the same as if one of its routines had
+// returned it. It's used by the goroutines that run alongside the routines.
+func (s *routineExitSettings[InputType, OutputType, OutputChanType, ProcessingFuncType]) fail(err error) {
+	serr := stackerr.Wrap(err)
+	s.setExitErr(serr)
+	s.upstreamCtxCancel.cancel(serr)
 }
 
 func getRoutineExit[
@@ -33,10 +59,8 @@ func getRoutineExit[
 	ProcessingFuncType ProcessingFuncTypes[InputType, OutputType],
 ](
 	settings *routineExitSettings[InputType, OutputType, OutputChanType, ProcessingFuncType],
-) func(err stackerr.Error, routineIdx uint, cleanupFunc func(lastOutput *time.Time, callbackTracker *timeTracker) stackerr.Error, lastOutput *time.Time, callbackTracker *timeTracker) stackerr.Error {
-	var errLock sync.Mutex
-	var exitErr stackerr.Error
-	return func(err stackerr.Error, routineIdx uint, cleanupFunc func(lastOutput *time.Time, callbackTracker *timeTracker) stackerr.Error, lastOutput *time.Time, callbackTracker *timeTracker) stackerr.Error {
+) func(err stackerr.Error, state *routineState, retired bool, cleanupFunc func(lastOutput *time.Time, callbackTracker *timeTracker) stackerr.Error, lastOutput *time.Time, callbackTracker *timeTracker) stackerr.Error {
+	return func(err stackerr.Error, state *routineState, retired bool, cleanupFunc func(lastOutput *time.Time, callbackTracker *timeTracker) stackerr.Error, lastOutput *time.Time, callbackTracker *timeTracker) stackerr.Error {
 
 		isLastRoutine := false
 
@@ -45,35 +69,50 @@ func getRoutineExit[
 			// If it did, save it as the global exit error for the executor.
 			// Even if it's just a context error, it will still trigger
 			// the termination of all routines for this executor.
-			errLock.Lock()
-			if exitErr == nil {
-				exitErr = err
-			}
-			errLock.Unlock()
+			settings.setExitErr(err)
 
 			// Update the status of this routine
 			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-				isLastRoutine = settings.routineStatusTracker.updateRoutineStatus(routineIdx, ContextDone)
+				isLastRoutine = settings.routineStatusTracker.updateRoutineStatus(state, ContextDone)
 			} else {
-				isLastRoutine = settings.routineStatusTracker.updateRoutineStatus(routineIdx, Errored)
+				isLastRoutine = settings.routineStatusTracker.updateRoutineStatus(state, Errored)
 			}
 
 			// As soon as one routine fails, it's game over for everything in this executor
 			// AND every upstream executor, because all upstream results would die here
 			// anyways. Cancel the internal context and all upstream contexts.
-			settings.upstreamCtxCancel.cancel()
+			// The error is used as the cause of the cancellation.
+			settings.upstreamCtxCancel.cancel(err)
 
+		} else if retired {
+			isLastRoutine = settings.routineStatusTracker.updateRoutineStatus(state, Retired)
 		} else {
-			isLastRoutine = settings.routineStatusTracker.updateRoutineStatus(routineIdx, Finished)
+			isLastRoutine = settings.routineStatusTracker.updateRoutineStatus(state, Finished)
 		}
 
 		// If it's the last routine to exit, do some special things
 		if isLastRoutine {
 
+			// Nothing can be taken from the requeue queue anymore, so
+			// stop the timers of the inputs that are waiting in it.
+			settings.requeueQueue.Stop()
+
+			// The watchdog and autoscaler may still be reading their values,
+			// so the executor callbacks get values of their own.
+			callbackInput := settings.baseExecutorCallbackInput.clone()
+
+			// Report how the time of the routines was spent
+			callbackInput.Utilization = settings.routineStatusTracker.GetUtilization()
+
+			// Report how the processing of upstream outputs went after the upstream executor failed
+			if settings.upstreamErrorDrain != nil {
+				callbackInput.UpstreamErrorDrain = settings.upstreamErrorDrain.result(settings.routineStatusTracker.GetInputChanLength())
+			}
+
 			// Get the original error that triggered the termination of the routines.
-			errLock.Lock()
-			err = exitErr
-			errLock.Unlock()
+			settings.exitErrLock.Lock()
+			err = settings.exitErr
+			settings.exitErrLock.Unlock()
 
 			// Check if this executor was terminated intentionally
 			if err != nil {
@@ -85,9 +124,15 @@ func getRoutineExit[
 					// The context was cancelled.
 
 					// If there are upstream executors, wait for them to finish.
-					// Use the upstream exit error as this executor's exit error.
-					if settings.executorInput.upstream != nil {
-						err = settings.executorInput.upstream.Wait()
+					// Use the upstream exit error as this executor's exit error, unless
+					// the upstream executors had already finished successfully (e.g. the
+					// chain was drained) before this one was cancelled.
+					// Isolated executors only wait if the upstream executor failed,
+					// since otherwise it may still be feeding other executors.
+					if settings.executorInput.upstream != nil && (settings.executorInput.CancellationPolicy != CancellationPolicyIsolate || settings.executorInput.upstream.Ctx().Err() != nil) {
+						if upstreamErr := settings.executorInput.upstream.Wait(); upstreamErr != nil {
+							err = upstreamErr
+						}
 					}
 
 					// Otherwise, there are no upstream executors, which means that the context
@@ -97,8 +142,9 @@ func getRoutineExit[
 					// Run the callback for the executor's cancellation
 					if settings.executorInput.ExecutorContextDoneCallback != nil {
 						newErr := settings.executorInput.ExecutorContextDoneCallback(&ExecutorContextDoneCallbackInput{
-							settings.baseExecutorCallbackInput,
+							callbackInput,
 							err,
+							contextCause(settings.internalCtx, err),
 						})
 						if newErr != nil {
 							err = newErr
@@ -109,15 +155,16 @@ func getRoutineExit[
 					// It wasn't a context cancellation, so it must have been an error in this routine.
 
 					// Wait for all upstream executors to complete, but we don't care about their returned
-					// errors because we want to return the error from this executor.
-					if settings.executorInput.upstream != nil {
+					// errors because we want to return the error from this executor. Isolated executors
+					// don't wait, since the upstream executors weren't cancelled and keep running.
+					if settings.executorInput.upstream != nil && settings.executorInput.CancellationPolicy != CancellationPolicyIsolate {
 						settings.executorInput.upstream.Wait()
 					}
 
 					// Run the callback for the executor's failure
 					if settings.executorInput.ExecutorErrorCallback != nil {
 						newErr := settings.executorInput.ExecutorErrorCallback(&ExecutorErrorCallbackInput{
-							settings.baseExecutorCallbackInput,
+							callbackInput,
 							err,
 						})
 						if newErr != nil {
@@ -133,9 +180,11 @@ func getRoutineExit[
 
 				// However, this does not necessarily mean that all upstream executors completed successfully.
 				// They close their channels even if they throw errors, so we need to wait on them and check
-				// if they errored out.
+				// if they errored out. We wait on the error group directly instead of calling Wait(),
+				// since Wait() cancels the upstream passthrough context that this executor's internal
+				// context is derived from, and the final batch may still need to be sent.
 				if settings.executorInput.upstream != nil {
-					err = settings.executorInput.upstream.Wait()
+					err = stackerr.Wrap(settings.executorInput.upstream.errorGroup.Wait())
 				}
 
 				if err != nil {
@@ -143,8 +192,9 @@ func getRoutineExit[
 					// We consider this to be a context cancellation, so run the appropriate callback.
 					if settings.executorInput.ExecutorContextDoneCallback != nil {
 						newErr := settings.executorInput.ExecutorContextDoneCallback(&ExecutorContextDoneCallbackInput{
-							settings.baseExecutorCallbackInput,
+							callbackInput,
 							err,
+							contextCause(settings.internalCtx, err),
 						})
 						if newErr != nil {
 							err = newErr
@@ -161,7 +211,7 @@ func getRoutineExit[
 							// Run the callback for the executor's failure
 							if settings.executorInput.ExecutorErrorCallback != nil {
 								newErr := settings.executorInput.ExecutorErrorCallback(&ExecutorErrorCallbackInput{
-									settings.baseExecutorCallbackInput,
+									callbackInput,
 									err,
 								})
 								if newErr != nil {
@@ -171,10 +221,15 @@ func getRoutineExit[
 						}
 					}
 
+					// Now that the final batch has been sent, finish waiting on the upstream executor
+					if settings.executorInput.upstream != nil {
+						settings.executorInput.upstream.Wait()
+					}
+
 					// Run the callback for the executor's successful completion.
 					if err == nil && settings.executorInput.ExecutorSuccessCallback != nil {
 						newErr := settings.executorInput.ExecutorSuccessCallback(&ExecutorSuccessCallbackInput{
-							settings.baseExecutorCallbackInput,
+							callbackInput,
 						})
 						if newErr != nil {
 							err = newErr
@@ -183,6 +238,18 @@ func getRoutineExit[
 				}
 			}
 
+			// If an isolated executor was cancelled, its upstream executor keeps running. If no
+			// other executors consume its outputs, drop them, so that it can still finish.
+			if settings.executorInput.upstream != nil && settings.executorInput.upstream.removeConsumer() && err != nil && settings.executorInput.CancellationPolicy == CancellationPolicyIsolate {
+				go settings.executorInput.upstream.discardOutputs()
+			}
+
+			// If items are being tracked through the chain, let the tracker know that
+			// this executor is done, so it can run any compensations if the chain failed.
+			if settings.itemTracker != nil {
+				err = settings.itemTracker.stageExited(err)
+			}
+
 			// When the routines have finished, whether that be due to an error
 			// or due to them completing their task (no more inputs to process),
 			// close the output channel. This signals to downstream executor that
@@ -197,10 +264,11 @@ func getRoutineExit[
 			if err != nil {
 				// If an error occured at all, here or higher in the chain,
 				// cancel our passthrough context.
-				settings.passthroughCtxCancel()
+				settings.passthroughCtxCancel(err)
 				// Close the channel that only gets closed if there's an error.
 				close(settings.errChan)
 			}
+			close(settings.finished)
 			return err
 		} else {
 			// The final routine to exit will return this error instead.
@@ -218,7 +286,7 @@ type routineSettings[
 	executorInput                           *executorInput[InputType, OutputType, OutputChanType, ProcessingFuncType]
 	internalCtx                             context.Context
 	upstreamCtxCancel                       *upstreamCtxCancel
-	passthroughCtxCancel                    context.CancelFunc
+	passthroughCtxCancel                    context.CancelCauseFunc
 	routineStatusTracker                    *RoutineStatusTracker
 	routineStatusTrackersSlice              []*RoutineStatusTracker
 	routineStatusTrackersMap                map[string]*RoutineStatusTracker
@@ -233,6 +301,22 @@ type routineSettings[
 	processingFuncWithoutInputWithoutOutput ProcessingFuncWithoutInputWithoutOutput
 	forceWaitForInput                       bool
 	inputChan                               <-chan InputType
+	requeueQueue                            *requeueQueue[InputType]
+	rateLimiter                             *tokenBucket
+	keyedRateLimiter                        *keyedRateLimiter[InputType]
+	fairQueue                               *fairQueue[InputType]
+	scaler                                  *routineScaler
+	adaptiveLimiter                         *adaptiveLimiter
+	supervisor                              *supervisor
+	watchdogExecutorID                      uint64
+	pauser                                  *pauser
+	drained                                 <-chan struct{}
+	upstreamErrorDrain                      *upstreamErrorDrain
+	itemTracker                             *itemTracker
+	inputEdge                               *trackedEdge
+	outputEdge                              *trackedEdge
+	createRoots                             bool
+	stage                                   int
 	isBatchOutput                           bool
 	outputChan                              chan OutputChanType
 	outputFunc                              func(
@@ -246,7 +330,125 @@ type routineSettings[
 	) (
 		err stackerr.Error,
 	)
-	exitFunc func(err stackerr.Error, routineIdx uint, cleanupFunc func(lastOutput *time.Time, callbackTracker *timeTracker) stackerr.Error, lastOutput *time.Time, callbackTracker *timeTracker) stackerr.Error
+	exitFunc func(err stackerr.Error, state *routineState, retired bool, cleanupFunc func(lastOutput *time.Time, callbackTracker *timeTracker) stackerr.Error, lastOutput *time.Time, callbackTracker *timeTracker) stackerr.Error
+}
+
+// process calls whichever processing function was provided for the executor.
+func (settings *routineSettings[InputType, OutputType, OutputChanType, ProcessingFuncType]) process(ctx context.Context, input InputType, metadata *RoutineFunctionMetadata) (output OutputType, err stackerr.Error) {
+	switch {
+	case settings.processingFuncWithInputWithOutput != nil:
+		output, err = settings.processingFuncWithInputWithOutput(ctx, input, metadata)
+	case settings.processingFuncWithInputWithoutOutput != nil:
+		err = settings.processingFuncWithInputWithoutOutput(ctx, input, metadata)
+	case settings.processingFuncWithoutInputWithOutput != nil:
+		output, err = settings.processingFuncWithoutInputWithOutput(ctx, metadata)
+	case settings.processingFuncWithoutInputWithoutOutput != nil:
+		err = settings.processingFuncWithoutInputWithoutOutput(ctx, metadata)
+	}
+	return output, err
+}
+
+// acquireLimiter waits for a slot from the adaptive limiter and takes the cost of
+// processing an input from the shared limiter, if there are any. Returns false if
+// the context was done while waiting.
+func (settings *routineSettings[InputType, OutputType, OutputChanType, ProcessingFuncType]) acquireLimiter(state *routineState, input InputType) (cost int64, ok bool) {
+	onWait := func() {
+		settings.routineStatusTracker.updateRoutineStatus(state, AwaitingLimiter)
+	}
+	// The adaptive limit is only for this executor, so wait for it first instead
+	// of holding on to capacity of the shared limiter in the meantime.
+	if settings.adaptiveLimiter != nil && !settings.adaptiveLimiter.acquire(settings.internalCtx, onWait) {
+		return 0, false
+	}
+	limiter := settings.executorInput.Limiter
+	if limiter == nil {
+		return 0, true
+	}
+	cost = 1
+	if settings.executorInput.LimiterCost != nil {
+		cost = settings.executorInput.LimiterCost(input)
+	}
+	cost = limiter.clampCost(cost)
+	waited, err := limiter.acquire(settings.internalCtx, cost, onWait)
+	settings.routineStatusTracker.addLimiterWait(waited)
+	if err != nil {
+		if settings.adaptiveLimiter != nil {
+			settings.adaptiveLimiter.release(0, false, false)
+		}
+		return 0, false
+	}
+	return cost, true
+}
+
+// runProcess calls the processing function (through the panic handler, if there is
+// one), and gives the slot and the cost of the call back to the limiters once it
+// returns. The adaptive limit is updated with how the call went.
+func (settings *routineSettings[InputType, OutputType, OutputChanType, ProcessingFuncType]) runProcess(input InputType, metadata *RoutineFunctionMetadata, limiterCost int64) (output OutputType, skip bool, processedAt time.Time, err stackerr.Error) {
+	if limiterCost > 0 {
+		defer settings.executorInput.Limiter.release(limiterCost)
+	}
+	// Whether the call returned, instead of panicking (panics are
+	// counted by the routine when it recovers from them).
+	var returned bool
+	defer func() {
+		// Requeues aren't failures, and calls that were cut short by the
+		// context being cancelled didn't finish.
+		if !returned || settings.internalCtx.Err() != nil || isRequeue(err) {
+			return
+		}
+		// Skipped inputs are the ones that panicked
+		failErr := error(err)
+		if skip {
+			failErr = errors.New("the processing function panicked and the input was skipped")
+		}
+		processedAt = settings.routineStatusTracker.addProcessed(metadata.state, failErr)
+	}()
+	if settings.adaptiveLimiter != nil {
+		start := time.Now()
+		defer func() {
+			// Calls that were cut short by the context being cancelled
+			// don't say anything about the load.
+			settings.adaptiveLimiter.release(time.Since(start), err != nil || skip, settings.internalCtx.Err() == nil)
+		}()
+	}
+	// The call gets its own context, which is cancelled if it stops sending heartbeats
+	callCtx, stopHeartbeat := metadata.state.heartbeat.watch(settings.internalCtx, settings.executorInput.HeartbeatTimeout)
+	defer stopHeartbeat()
+	if settings.executorInput.PanicHandler != nil {
+		output, skip, err = processWithPanicHandler(settings, callCtx, input, metadata)
+	} else {
+		output, err = settings.process(callCtx, input, metadata)
+	}
+	returned = true
+	if settings.executorInput.HeartbeatTimeout > 0 && heartbeatTimedOut(callCtx) && settings.internalCtx.Err() == nil {
+		// Whatever the call returned, it stopped sending heartbeats for too long
+		var zero OutputType
+		return zero, false, processedAt, stackerr.Wrap(ErrHeartbeatTimeout)
+	}
+	return output, skip, processedAt, err
+}
+
+// restart records the failure of a supervised routine and returns how long to wait
+// before restarting it. Returns the error to fail with instead, if the routine can't
+// be restarted.
+func (settings *routineSettings[InputType, OutputType, OutputChanType, ProcessingFuncType]) restart(err stackerr.Error, metadata *RoutineFunctionMetadata) (backoff time.Duration, failErr stackerr.Error) {
+	restarts, backoff, ok := settings.supervisor.restart()
+	if !ok {
+		// Too many restarts, so escalate to a failure of the executor
+		return 0, err
+	}
+	if settings.executorInput.Supervisor.Callback != nil {
+		if callbackErr := settings.executorInput.Supervisor.Callback(&RoutineRestartCallbackInput{
+			RoutineFunctionMetadata: metadata,
+			Err:                     err,
+			Restarts:                restarts,
+			Backoff:                 backoff,
+		}); callbackErr != nil {
+			return 0, callbackErr
+		}
+	}
+	settings.routineStatusTracker.addRestart()
+	return backoff, nil
 }
 
 func getRoutine[
@@ -259,7 +461,10 @@ func getRoutine[
 	routineIdx uint,
 ) func() error {
 
+	state := settings.routineStatusTracker.getRoutineState(routineIdx)
+
 	routineFunctionMetadata := &RoutineFunctionMetadata{
+		state:                      state,
 		ExecutorName:               settings.executorInput.Name,
 		RoutineIndex:               routineIdx,
 		RoutineStatusTracker:       settings.routineStatusTracker,
@@ -282,11 +487,23 @@ func getRoutine[
 		if settings.executorInput.RoutineContextDoneCallback != nil {
 			return settings.executorInput.RoutineContextDoneCallback(&RoutineContextDoneCallbackInput{
 				RoutineFunctionMetadata: getRoutineFunctionMetadata(executorInputIdx, routineInputIdx),
-				Err:                     stackerr.Wrap(settings.internalCtx.Err()),
+				Err:                     contextError(settings.internalCtx),
 			})
 		}
 		// Return the error that caused the context to cancel
-		return stackerr.Wrap(settings.internalCtx.Err())
+		return contextError(settings.internalCtx)
+	}
+
+	// The lineage of the item this routine is working on, if items are being tracked
+	item := &trackedItem{}
+
+	// Releases the item when its input is dropped without being output, so that
+	// its roots can finish.
+	dropItem := func() {
+		if settings.itemTracker != nil && item.lineage != nil {
+			settings.itemTracker.release(item.lineage)
+			item.lineage = nil
+		}
 	}
 
 	getInputSettings := &getInputSettings[InputType, OutputType, OutputChanType, ProcessingFuncType]{
@@ -295,7 +512,27 @@ func getRoutine[
 		executorInput:                     settings.executorInput,
 		emptyInputChannelCallbackInterval: settings.emptyInputChannelCallbackInterval,
 		inputChan:                         settings.inputChan,
+		requeueQueue:                      settings.requeueQueue,
+		itemTracker:                       settings.itemTracker,
+		inputEdge:                         settings.inputEdge,
+		createRoots:                       settings.createRoots,
+		item:                              item,
 		getRoutineFunctionMetadata:        getRoutineFunctionMetadata,
+		rateLimiter:                       settings.rateLimiter,
+		keyedRateLimiter:                  settings.keyedRateLimiter,
+		scaler:                            settings.scaler,
+		pauser:                            settings.pauser,
+		drained:                           settings.drained,
+		routineStatusTracker:              settings.routineStatusTracker,
+		state:                             state,
+	}
+	if settings.fairQueue != nil {
+		// The inputs come from the fair queue's dispatcher instead, which
+		// takes care of the lineages of tracked items.
+		getInputSettings.fairChan = settings.fairQueue.output
+		getInputSettings.inputChan = nil
+		getInputSettings.inputEdge = nil
+		getInputSettings.createRoots = false
 	}
 
 	saveOutputSettings := &saveOutputSettings[OutputChanType]{
@@ -308,6 +545,10 @@ func getRoutine[
 		outputIndexCounter:                settings.outputIndexCounter,
 		getRoutineFunctionMetadata:        getRoutineFunctionMetadata,
 		batchTimeTracker:                  settings.batchTimeTracker,
+		outputEdge:                        settings.outputEdge,
+		item:                              item,
+		routineStatusTracker:              settings.routineStatusTracker,
+		state:                             state,
 	}
 
 	var routineInputIndex uint64 = 0
@@ -322,10 +563,18 @@ func getRoutine[
 
 	return func() (err error) {
 
+		// Label the routine, so that the watchdog can find its stack
+		if settings.watchdogExecutorID != 0 {
+			pprof.SetGoroutineLabels(pprof.WithLabels(settings.internalCtx, watchdogLabels(settings.executorInput.Name, settings.watchdogExecutorID, routineIdx)))
+		}
+
 		// This tracks the times of the last successful input pull
 		lastInput := time.Now()
 		lastOutput := time.Now()
 
+		// Whether this routine exited because the concurrency was reduced
+		var retired bool
+
 		inputCallbackTracker := newTimeTracker(0, false)
 		if settings.executorInput.EmptyInputChannelCallback != nil {
 			inputCallbackTracker = newTimeTracker(settings.emptyInputChannelCallbackInterval, false)
@@ -339,113 +588,326 @@ func getRoutine[
 		defer func() {
 			// Convert panics into errors
 			if r := recover(); r != nil {
-				if perr, ok := r.(stackerr.Error); ok {
-					err = stackerr.Errorf("%s: %s", perr.Error(), string(debug.Stack()))
-				} else {
-					err = stackerr.Errorf("%v: %s", r, string(debug.Stack()))
+				// If the panic handler asked for the panic to be raised
+				// again, do so without converting it.
+				if rp, ok := r.(*repanic); ok {
+					panic(rp.err)
 				}
+				err = panicToError(r, debug.Stack())
 			}
-			err = settings.exitFunc(stackerr.Wrap(err), routineIdx, cleanupFunc, &lastOutput, outputCallbackTracker)
+			err = settings.exitFunc(stackerr.Wrap(err), state, retired, cleanupFunc, &lastOutput, outputCallbackTracker)
 		}()
 
 		var metadata *RoutineFunctionMetadata
 
-		// If we want to force get an input, or if it's a processing function that uses an input, get an input for each loop
-		shouldGetInput := settings.forceWaitForInput || settings.processingFuncWithInputWithOutput != nil || settings.processingFuncWithInputWithoutOutput != nil
+		// The number of times the executor had been restarted when this routine
+		// last started, and whether it has to restart because that changed.
+		generation := settings.supervisor.getGeneration()
+		var rejoin bool
+
+		// This runs the routine until it exits or fails
+		run := func() (err error) {
+			defer func() {
+				// Convert panics into errors, so that the routine can be restarted.
+				// Panics that have to be raised again are passed on as they are.
+				if r := recover(); r != nil {
+					if rp, ok := r.(*repanic); ok {
+						panic(rp)
+					}
+					err = panicToError(r, debug.Stack())
+					settings.routineStatusTracker.addProcessed(state, err)
+				}
+			}()
 
-		var output OutputType
-		var input InputType
-		var forceSendBatch bool
-		var executorInputIndex uint64
+			// Whether the processing function takes an input
+			hasInput := settings.processingFuncWithInputWithOutput != nil || settings.processingFuncWithInputWithoutOutput != nil
 
-		for {
-			// Find the index of this input retrieval
-			executorInputIndex = atomic.AddUint64(settings.inputIndexCounter, 1) - 1
-
-			// Load the metadata
-			metadata = getRoutineFunctionMetadata(executorInputIndex, routineInputIndex)
-			routineInputIndex++
-
-			if shouldGetInput {
-				// Get the input from the input channel
-				var inputChanClosed bool
-				input, inputChanClosed, forceSendBatch, err = getInput(getInputSettings, executorInputIndex, routineInputIndex, &lastInput, inputCallbackTracker, settings.batchTimeTracker)
-				// If there was an error, or the input channel is closed, exit
-				if err != nil {
-					return err
+			// If we want to force get an input, or if it's a processing function that uses an input, get an input for each loop
+			shouldGetInput := settings.forceWaitForInput || hasInput
+
+			var output OutputType
+			var input InputType
+			var forceSendBatch bool
+			var executorInputIndex uint64
+
+			for {
+				// Another routine failed and the whole executor is restarting
+				if settings.supervisor.getGeneration() != generation {
+					rejoin = true
+					return nil
 				}
-				if inputChanClosed {
-					// If the input channel is closed, there's nothing left to do,
-					// so we call that a success for this routine.
-					if settings.executorInput.RoutineSuccessCallback != nil {
-						return settings.executorInput.RoutineSuccessCallback(&RoutineSuccessCallbackInput{
-							RoutineFunctionMetadata: metadata,
-						})
+
+				// Find the index of this input retrieval
+				executorInputIndex = atomic.AddUint64(settings.inputIndexCounter, 1) - 1
+				atomic.StoreUint64(&state.inputIndex, executorInputIndex)
+
+				// Load the metadata
+				metadata = getRoutineFunctionMetadata(executorInputIndex, routineInputIndex)
+				routineInputIndex++
+
+				// Clear the lineage of the previous item
+				item.lineage = nil
+
+				if shouldGetInput {
+					// Get the input from the input channel
+					var inputChanClosed bool
+					input, metadata.RequeueCount, inputChanClosed, retired, forceSendBatch, err = getInput(getInputSettings, executorInputIndex, routineInputIndex, &lastInput, lastOutput, inputCallbackTracker, settings.batchTimeTracker)
+					// If there was an error, or the input channel is closed, exit
+					if err != nil {
+						return err
+					}
+					// There are more routines than the executor should have,
+					// so this one exits.
+					if retired {
+						return nil
+					}
+					if inputChanClosed {
+						// If the input channel is closed, there's nothing left to do,
+						// so we call that a success for this routine.
+						if settings.executorInput.RoutineSuccessCallback != nil {
+							return settings.executorInput.RoutineSuccessCallback(&RoutineSuccessCallbackInput{
+								RoutineFunctionMetadata: metadata,
+							})
+						}
+						return err
+					}
+					// If the upstream executor failed, this could be one input too many to process
+					if settings.upstreamErrorDrain != nil && !forceSendBatch && !settings.upstreamErrorDrain.take() {
+						dropItem()
+						return ctxCancelledFunc(executorInputIndex, routineInputIndex)
+					}
+				} else {
+					// There are more routines than the executor should have, so this one exits
+					if settings.scaler.shouldRetire() {
+						retired = true
+						return nil
 					}
-					return err
-				}
-			} else {
-				// Since we didn't use the getInput function, we haven't checked for
-				// the context being done or whether we should force-send a batch.
-				// So, check that now.
-				if err := stackerr.Wrap(settings.internalCtx.Err()); err != nil {
-					return err
-				}
 
-				if settings.batchTimeTracker.TimerChan() != nil {
-					select {
-					// This will trigger if there's a batch timer and it's ready
-					case <-settings.batchTimeTracker.TimerChan():
-						forceSendBatch = true
-					default:
+					// Wait until the executor isn't paused
+					if !settings.pauser.wait(settings.internalCtx, settings.drained, func() {
+						settings.routineStatusTracker.updateRoutineStatus(state, Paused)
+					}) {
+						return ctxCancelledFunc(executorInputIndex, routineInputIndex)
+					}
+
+					// Once the chain is drained, the processing function isn't called
+					// anymore, so we call that a success for this routine.
+					if isClosed(settings.drained) {
+						if settings.executorInput.RoutineSuccessCallback != nil {
+							return settings.executorInput.RoutineSuccessCallback(&RoutineSuccessCallbackInput{
+								RoutineFunctionMetadata: metadata,
+							})
+						}
+						return nil
+					}
+
+					// Wait until the rate limit allows calling the processing function again
+					if _, ok := settings.rateLimiter.wait(settings.internalCtx, func() {
+						settings.routineStatusTracker.updateRoutineStatus(state, RateLimited)
+					}); !ok {
+						return ctxCancelledFunc(executorInputIndex, routineInputIndex)
+					}
+
+					// Since we didn't use the getInput function, we haven't checked for
+					// the context being done or whether we should force-send a batch.
+					// So, check that now.
+					if err := contextError(settings.internalCtx); err != nil {
+						return err
+					}
+
+					if settings.batchTimeTracker.TimerChan() != nil {
+						select {
+						// This will trigger if there's a batch timer and it's ready
+						case <-settings.batchTimeTracker.TimerChan():
+							forceSendBatch = true
+						default:
+						}
+					}
+
+					if forceSendBatch {
+						// The processing function won't be called, so the token wasn't used
+						settings.rateLimiter.refund()
+					}
+
+					// If this is the first tracked executor, each call starts a new lineage
+					if settings.createRoots && !forceSendBatch {
+						item.lineage = settings.itemTracker.newRoot()
 					}
 				}
-			}
 
-			if !forceSendBatch {
-				switch {
-				case settings.processingFuncWithInputWithOutput != nil:
-					output, err = settings.processingFuncWithInputWithOutput(settings.internalCtx, input, metadata)
-				case settings.processingFuncWithInputWithoutOutput != nil:
-					err = settings.processingFuncWithInputWithoutOutput(settings.internalCtx, input, metadata)
-				case settings.processingFuncWithoutInputWithOutput != nil:
-					output, err = settings.processingFuncWithoutInputWithOutput(settings.internalCtx, metadata)
-				case settings.processingFuncWithoutInputWithoutOutput != nil:
-					err = settings.processingFuncWithoutInputWithoutOutput(settings.internalCtx, metadata)
+				// In result mode, inputs that already failed upstream are passed straight
+				// through without being processed.
+				var resultOutput OutputChanType
+				useResultOutput := false
+				var inputAt time.Time
+				if !forceSendBatch {
+					// An input from the input channel was taken when the last input time was set
+					inputAt = lastInput
+					if !shouldGetInput {
+						inputAt = time.Now()
+					}
+					settings.routineStatusTracker.addInput(inputAt)
+				}
+				if !forceSendBatch && settings.executorInput.resultPassthrough != nil {
+					resultOutput, useResultOutput = settings.executorInput.resultPassthrough(input)
 				}
 
-				// The processing function returned an error
-				if err != nil {
-					// First check if the context has been cancelled. If it has been, return
-					// that error instead of the processing error, since we don't really care
-					// about the processing error if the context was cancelled anyways.
-					if settings.internalCtx.Err() != nil {
+				// When the processing function finished, which is
+				// when the routine starts waiting to output
+				var outputAt time.Time
+				if !forceSendBatch && !useResultOutput {
+					limiterCost, ok := settings.acquireLimiter(state, input)
+					if !ok {
 						return ctxCancelledFunc(executorInputIndex, routineInputIndex)
 					}
+					settings.routineStatusTracker.updateRoutineStatusAt(state, Processing, inputAt)
+					var skip bool
+					output, skip, outputAt, err = settings.runProcess(input, metadata, limiterCost)
+					// The panic handler decided to drop this input, so
+					// there's nothing to output for it.
+					if skip {
+						dropItem()
+						continue
+					}
+
+					// The processing function returned an error
+					if err != nil {
+						outputAt = time.Time{}
+						// First check if the context has been cancelled. If it has been, return
+						// that error instead of the processing error, since we don't really care
+						// about the processing error if the context was cancelled anyways.
+						if settings.internalCtx.Err() != nil {
+							return ctxCancelledFunc(executorInputIndex, routineInputIndex)
+						}
+
+						// Check if the processing function asked for the input to be requeued
+						var rqErr *requeueError
+						if errors.As(err, &rqErr) && !hasInput {
+							err = stackerr.Errorf("the processing function returned the error from Requeue, but it doesn't take an input that could be requeued")
+						} else if rqErr != nil {
+							requeueCount := metadata.RequeueCount + 1
+							maxRequeues := zeroDefault(settings.executorInput.MaxRequeues, DefaultMaxRequeues)
+							if maxRequeues < 0 || requeueCount <= uint(maxRequeues) {
+								// Put it back in the queue and move on to the next input
+								settings.requeueQueue.Push(requeuedInput[InputType]{
+									input:        input,
+									requeueCount: requeueCount,
+									lineage:      item.lineage,
+								}, rqErr.delay)
+								continue
+							}
+							// It's been requeued too many times, so quarantine it
+							if settings.executorInput.QuarantineCallback != nil {
+								if err := settings.executorInput.QuarantineCallback(&QuarantineCallbackInput[InputType]{
+									RoutineFunctionMetadata: metadata,
+									Input:                   input,
+								}); err != nil {
+									return err
+								}
+								dropItem()
+								continue
+							}
+							// There's nowhere to quarantine it, so treat it as a failure
+							err = stackerr.Errorf("input was requeued more than the maximum of %d times", maxRequeues)
+						}
+
+						// If there's a fallback function, use it to try to produce a substitute output
+						if settings.executorInput.Fallback != nil {
+							output, err = settings.executorInput.Fallback(settings.internalCtx, input, stackerr.Wrap(err), metadata)
+							if err == nil {
+								// The fallback succeeded, so output its result as if the processing
+								// function had succeeded.
+								settings.routineStatusTracker.addFallback()
+							} else if settings.internalCtx.Err() != nil {
+								return ctxCancelledFunc(executorInputIndex, routineInputIndex)
+							}
+						}
+					}
+
+					// In result mode, errors are sent downstream as values instead
+					if err != nil && settings.executorInput.resultError != nil {
+						resultOutput = settings.executorInput.resultError(input, stackerr.Wrap(err), metadata)
+						useResultOutput = true
+						err = nil
+					}
+
+					// The error is ignored, so drop the input and move on to the next one
+					if err != nil && settings.executorInput.CancellationPolicy == CancellationPolicyIgnore {
+						settings.routineStatusTracker.addIgnoredError()
+						dropItem()
+						continue
+					}
 
-					// If there's a callback for the function throwing an error, call it
-					if settings.executorInput.RoutineErrorCallback != nil {
-						return settings.executorInput.RoutineErrorCallback(&RoutineErrorCallbackInput{
-							RoutineFunctionMetadata: getRoutineFunctionMetadata(executorInputIndex, routineInputIndex),
-							Err:                     stackerr.Wrap(err),
+					// The processing function (and the fallback, if there is one) returned an error
+					if err != nil {
+						// If there's a callback for the function throwing an error, call it
+						if settings.executorInput.RoutineErrorCallback != nil {
+							return settings.executorInput.RoutineErrorCallback(&RoutineErrorCallbackInput{
+								RoutineFunctionMetadata: getRoutineFunctionMetadata(executorInputIndex, routineInputIndex),
+								Err:                     stackerr.Wrap(err),
+							})
+						}
+						// Otherwise, just return the error
+						return err
+					}
+				}
+
+				if useResultOutput || settings.outputFunc != nil {
+					settings.routineStatusTracker.updateRoutineStatusAt(state, AwaitingOutput, outputAt)
+				}
+				if useResultOutput {
+					// Send the error result directly into the output channel
+					err := saveOutput(saveOutputSettings, resultOutput, executorInputIndex, routineInputIndex, &lastOutput, outputCallbackTracker, false)
+					if err != nil {
+						return err
+					}
+				} else if settings.outputFunc != nil {
+					// If there's an output function to output with, output the result
+					// If forceSendBatch is true (when a batch output timer times out), this will
+					// only output the existing batch and will not actually add a value to the batch.
+					// Otherwise, it sends the output either into the batch or directly into the
+					// output channel, depending on whether batching is being used.
+					err := settings.outputFunc(saveOutputSettings, output, executorInputIndex, routineInputIndex, &lastOutput, outputCallbackTracker, forceSendBatch)
+					if err != nil {
+						return err
+					}
+				}
+
+				// If items are being tracked, this routine is done with the item
+				if settings.itemTracker != nil && !forceSendBatch {
+					// Inputs that were output as error results have nothing to compensate
+					if settings.executorInput.Compensate != nil && !useResultOutput {
+						compensateInput := input
+						settings.itemTracker.record(settings.stage, item.lineage, func(ctx context.Context) stackerr.Error {
+							return settings.executorInput.Compensate(ctx, compensateInput)
 						})
 					}
-					// Otherwise, just return the error
-					return err
+					settings.itemTracker.release(item.lineage)
 				}
 			}
+		}
 
-			// If there's an output function to output with, output the result
-			if settings.outputFunc != nil {
-				// If forceSendBatch is true (when a batch output timer times out), this will
-				// only output the existing batch and will not actually add a value to the batch.
-				// Otherwise, it sends the output either into the batch or directly into the
-				// output channel, depending on whether batching is being used.
-				err := settings.outputFunc(saveOutputSettings, output, executorInputIndex, routineInputIndex, &lastOutput, outputCallbackTracker, forceSendBatch)
-				if err != nil {
-					return err
-				}
+		for {
+			rejoin = false
+			err = run()
+			var backoff time.Duration
+			if rejoin {
+				// Another routine failed, so this one restarts along with it
+				err = nil
+			} else if err == nil || retired || settings.supervisor == nil || settings.internalCtx.Err() != nil {
+				return err
+			} else if backoff, err = settings.restart(stackerr.Wrap(err), metadata); err != nil {
+				return err
+			}
+
+			// The input that was being processed is dropped
+			dropItem()
+
+			settings.routineStatusTracker.updateRoutineStatus(state, Restarting)
+			if !settings.supervisor.wait(settings.internalCtx, backoff) {
+				return ctxCancelledFunc(atomic.LoadUint64(settings.inputIndexCounter), routineInputIndex)
 			}
+			generation = settings.supervisor.getGeneration()
 		}
 	}
 }
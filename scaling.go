@@ -0,0 +1,97 @@
+package concurrency
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// routineScaler tracks the target number of routines of an executor, so that it
+// can be changed while the executor is running. Extra routines are started right
+// away, and routines over the target retire the next time they're idle.
+type routineScaler struct {
+	lock sync.Mutex
+	// The number of routines the executor should be running
+	target int
+	// The index to use for the next routine that gets started
+	nextRoutineIdx uint
+	// The number of routines that still have to retire to get down to the target
+	toRetire int32
+	// A channel that gets closed (and replaced) whenever more routines
+	// have to retire, so that idle routines can check again.
+	changed atomic.Pointer[chan struct{}]
+	// Starts a new routine with the given index. Returns false if the executor
+	// has already finished, in which case no routine is started.
+	start func(routineIdx uint) bool
+}
+
+func newRoutineScaler(concurrency int) *routineScaler {
+	rs := &routineScaler{
+		target:         concurrency,
+		nextRoutineIdx: uint(concurrency),
+	}
+	changed := make(chan struct{})
+	rs.changed.Store(&changed)
+	return rs
+}
+
+// getTarget returns the number of routines the executor should be running.
+func (rs *routineScaler) getTarget() int {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	return rs.target
+}
+
+// setTarget changes the number of routines the executor should be running.
+func (rs *routineScaler) setTarget(concurrency int) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	delta := concurrency - rs.target
+	rs.target = concurrency
+	if delta < 0 {
+		atomic.AddInt32(&rs.toRetire, int32(-delta))
+		newChanged := make(chan struct{})
+		close(*rs.changed.Swap(&newChanged))
+		return
+	}
+	// Routines that haven't retired yet can keep running instead of
+	// starting new ones.
+	for delta > 0 {
+		pending := atomic.LoadInt32(&rs.toRetire)
+		if pending == 0 {
+			break
+		}
+		if atomic.CompareAndSwapInt32(&rs.toRetire, pending, pending-1) {
+			delta--
+		}
+	}
+	for ; delta > 0; delta-- {
+		if !rs.start(rs.nextRoutineIdx) {
+			// The executor has finished, so the routines that
+			// couldn't be started don't count.
+			rs.target -= delta
+			return
+		}
+		rs.nextRoutineIdx++
+	}
+}
+
+// retirementChanged returns a channel that gets closed when more routines
+// have to retire. It must be called before calling shouldRetire, so that
+// a change in between can't be missed.
+func (rs *routineScaler) retirementChanged() <-chan struct{} {
+	return *rs.changed.Load()
+}
+
+// shouldRetire checks whether there are more routines than the target and, if
+// so, claims one of the retirements for the calling routine.
+func (rs *routineScaler) shouldRetire() bool {
+	for {
+		pending := atomic.LoadInt32(&rs.toRetire)
+		if pending == 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&rs.toRetire, pending, pending-1) {
+			return true
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package concurrency
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+// BusyStage is the state of an executor that was still running when the
+// grace period of a shutdown ended.
+type BusyStage struct {
+	// The name of the executor
+	ExecutorName string
+	// The number of routines that were still running
+	NumRoutinesRunning int32
+	// The number of routines that were processing an input
+	NumRoutinesProcessing int32
+	// The number of routines that were waiting to store an output
+	NumRoutinesAwaitingOutput int32
+	// The number of inputs that were waiting in the executor's input channel
+	InputChanLength int
+}
+
+// ShutdownError is returned by Shutdown when the chain didn't finish draining
+// before the grace period ended, and it was cancelled instead.
+type ShutdownError struct {
+	// The error of the context that ended the grace period
+	Err error
+	// The executors in the chain that were still running when the grace period
+	// ended, in the order of the chain
+	BusyStages []BusyStage
+}
+
+func (se *ShutdownError) Error() string {
+	names := make([]string, len(se.BusyStages))
+	for i, stage := range se.BusyStages {
+		names[i] = stage.ExecutorName
+	}
+	return fmt.Sprintf("shutdown was forced before the chain finished draining (%s), still busy: %s", se.Err.Error(), strings.Join(names, ", "))
+}
+
+func (se *ShutdownError) Unwrap() error {
+	return se.Err
+}
+
+// Shutdown drains the chain (see Drain) and waits for it to finish. If the context
+// is done before the chain has finished draining, the chain is cancelled with a
+// ShutdownError as the cause, and Shutdown waits for it to stop and returns the
+// ShutdownError, which lists the executors that were still busy. Returns nil if the
+// chain drained cleanly, or the chain's own error if it failed while draining.
+func (eo *ExecutorOutput[OutputChanType]) Shutdown(ctx context.Context) stackerr.Error {
+	eo.Drain()
+	done := make(chan stackerr.Error, 1)
+	go func() {
+		done <- eo.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// The chain may have finished at the same time
+		select {
+		case err := <-done:
+			return err
+		default:
+		}
+	}
+
+	shutdownErr := &ShutdownError{
+		Err: ctx.Err(),
+	}
+	for _, tracker := range eo.routineStatusTrackersSlice {
+		if tracker.GetNumRoutinesRunning() == 0 {
+			continue
+		}
+		shutdownErr.BusyStages = append(shutdownErr.BusyStages, BusyStage{
+			ExecutorName:              tracker.GetExecutorName(),
+			NumRoutinesRunning:        tracker.GetNumRoutinesRunning(),
+			NumRoutinesProcessing:     tracker.GetNumRoutinesProcessing(),
+			NumRoutinesAwaitingOutput: tracker.GetNumRoutinesAwaitingOutput(),
+			InputChanLength:           tracker.GetInputChanLength(),
+		})
+	}
+	eo.upstreamCtxCancel.cancel(shutdownErr)
+	<-done
+	return stackerr.Wrap(shutdownErr)
+}
@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type routineStatus int
 
+// New statuses are added at the end, so that the values of the existing ones don't change.
 const (
 	AwaitingInput routineStatus = iota
 	Processing
@@ -15,8 +17,18 @@ const (
 	Errored
 	ContextDone
 	Finished
+	RateLimited
+	AwaitingLimiter
+	Retired
+	Paused
+	Restarting
 )
 
+// isTerminal returns whether a routine with the status has exited.
+func (s routineStatus) isTerminal() bool {
+	return s == Errored || s == ContextDone || s == Finished || s == Retired
+}
+
 func (s routineStatus) String() string {
 	switch s {
 	case AwaitingInput:
@@ -25,12 +37,22 @@ func (s routineStatus) String() string {
 		return "Processing"
 	case AwaitingOutput:
 		return "AwaitingOutput"
+	case RateLimited:
+		return "RateLimited"
+	case AwaitingLimiter:
+		return "AwaitingLimiter"
+	case Paused:
+		return "Paused"
+	case Restarting:
+		return "Restarting"
 	case Errored:
 		return "Errored"
 	case ContextDone:
 		return "ContextDone"
 	case Finished:
 		return "Finished"
+	case Retired:
+		return "Retired"
 	default:
 		panic(fmt.Errorf("unkown routineStatus: %d", s))
 	}
@@ -39,8 +61,21 @@ func (s routineStatus) String() string {
 type RoutineStatusTracker struct {
 	// Internal use only. The name of the executor it came from.
 	executorName string
-	// Internal use only. A map for tracking the current state of each routine.
-	routineStatuses sync.Map
+	// Internal use only. A map for tracking the current state of each routine that
+	// hasn't exited.
+	routineStates sync.Map
+	// Internal use only. The total time, in nanoseconds, that routines that have
+	// exited spent in each status.
+	timeInStatus [numRoutineStatuses]int64
+	// Internal use only. A lock for moving the state of a routine that has exited
+	// into the totals, so that it's never counted twice or not at all.
+	exitedLock sync.RWMutex
+	// Internal use only. The snapshots of the most recent routines that have exited,
+	// oldest first.
+	exitedRoutines []RoutineSnapshot
+	// Internal use only. The maximum number of routines that have exited to keep
+	// snapshots of.
+	maxExitedRoutines int
 	// Internal use only. A counter for the number of running routines.
 	numRoutinesRunning int32
 	// Internal use only. A counter for the number of routines awaiting an input.
@@ -49,12 +84,58 @@ type RoutineStatusTracker struct {
 	numRoutinesProcessingInput int32
 	// Internal use only. A counter for the number of routines that are currently awaiting a slot to store an output.
 	numRoutinesAwaitingOutput int32
+	// Internal use only. A counter for the number of routines that are currently waiting for the rate limit.
+	numRoutinesRateLimited int32
+	// Internal use only. A counter for the number of routines that are currently waiting for the shared
+	// or the adaptive limiter.
+	numRoutinesAwaitingLimiter int32
+	// Internal use only. A counter for the number of routines that are currently waiting for the executor to be resumed.
+	numRoutinesPaused int32
+	// Internal use only. A counter for the number of routines that are currently waiting to restart after a failure.
+	numRoutinesRestarting int32
 	// Internal use only. A counter for the number of routines that have errored and exited.
 	numRoutinesContextDone int32
 	// Internal use only. A counter for the number of routines that have exited because the context was cancelled.
 	numRoutinesErrored int32
 	// Internal use only. A counter for the number of routines that have successfully finished and exited.
 	numRoutinesFinished int32
+	// Internal use only. A counter for the number of routines that have exited because
+	// the concurrency of the executor was reduced.
+	numRoutinesRetired int32
+	// Internal use only. A counter for the number of failed inputs that were replaced
+	// by an output from the fallback function.
+	numFallbacks uint64
+	// Internal use only. The number of errors that were ignored
+	// because of CancellationPolicyIgnore.
+	numIgnoredErrors uint64
+	// Internal use only. The number of times a routine has been restarted
+	// by the supervisor after a failure.
+	numRestarts uint64
+	// Internal use only. The number of inputs the processing function has finished,
+	// successfully or not.
+	numProcessed uint64
+	// Internal use only. The number of times the processing function returned an
+	// error or panicked.
+	numErrors uint64
+	// Internal use only. When the processing function last finished an input, in
+	// Unix nanoseconds.
+	lastProgress int64
+	// Internal use only. When a routine last sent a heartbeat, in Unix nanoseconds.
+	lastHeartbeat int64
+	// Internal use only. When an input was last taken by a routine, in Unix nanoseconds.
+	lastInput int64
+	// Internal use only. When an output was last put into the output channel, in
+	// Unix nanoseconds.
+	lastOutput int64
+	// Internal use only. The capacity of the output channel, if there is one.
+	outputChanCapacity int
+	// Internal use only. A function that checks whether the chain is being drained.
+	isDraining func() bool
+	// Internal use only. A function that checks whether the executor is paused.
+	isPaused func() bool
+	// Internal use only. The total time, in nanoseconds, that routines
+	// have waited for the shared limiter.
+	limiterWaitTime int64
 	// Internal use only. A function that retrieves the length of the input channel. We
 	// use a function instead of storing a reference to the channel itself because the channel
 	// could have many different types, and we don't want to have to deal with those generics
@@ -65,17 +146,36 @@ type RoutineStatusTracker struct {
 	// could have many different types, and we don't want to have to deal with those generics
 	// here.
 	getOutputChanLength func() *int
+	// Internal use only. A function that retrieves the stats of the fair queue, if
+	// the executor uses fair queuing.
+	getFairQueueStats func() (depths map[string]int, served map[string]uint64)
+	// Internal use only. A function that retrieves the current adaptive limit, if
+	// the executor has one.
+	getAdaptiveLimit func() int
 }
 
-func (upo *RoutineStatusTracker) updateRoutineStatus(routineIdx uint, newStatus routineStatus) (isLastRoutine bool) {
-	previousStatusInterface, ok := upo.routineStatuses.Load(routineIdx)
-	if ok {
+func (upo *RoutineStatusTracker) updateRoutineStatus(state *routineState, newStatus routineStatus) (isLastRoutine bool) {
+	return upo.updateRoutineStatusAt(state, newStatus, time.Time{})
+}
+
+// updateRoutineStatusAt changes the status of a routine as of the given time, so
+// that a time the routine just got from the clock can be used again. If the time
+// is from before the routine entered its current status, the clock is used instead.
+func (upo *RoutineStatusTracker) updateRoutineStatusAt(state *routineState, newStatus routineStatus, at time.Time) (isLastRoutine bool) {
+	previousStatus := state.getStatus()
+	// If the status isn't actually changing, do nothing
+	if previousStatus == newStatus {
+		return
+	}
+	since := atomic.LoadInt64(&state.statusSince)
+	now := at.UnixNano()
+	if at.IsZero() || now < since {
+		now = time.Now().UnixNano()
+	}
+	if previousStatus != noStatus {
 		// If it already had a previously tracked state, decrement the corresponding counter for that state
-		previousStatus := previousStatusInterface.(routineStatus)
-		// If the status isn't actually changing, do nothing
-		if previousStatus == newStatus {
-			return
-		}
+		// Account for the time it spent in the previous state
+		upo.addTimeInStatus(state, previousStatus, time.Duration(now-since))
 		switch previousStatus {
 		case AwaitingInput:
 			atomic.AddInt32(&upo.numRoutinesAwaitingInput, -1)
@@ -83,17 +183,28 @@ func (upo *RoutineStatusTracker) updateRoutineStatus(routineIdx uint, newStatus
 			atomic.AddInt32(&upo.numRoutinesProcessingInput, -1)
 		case AwaitingOutput:
 			atomic.AddInt32(&upo.numRoutinesAwaitingOutput, -1)
+		case RateLimited:
+			atomic.AddInt32(&upo.numRoutinesRateLimited, -1)
+		case AwaitingLimiter:
+			atomic.AddInt32(&upo.numRoutinesAwaitingLimiter, -1)
+		case Paused:
+			atomic.AddInt32(&upo.numRoutinesPaused, -1)
+		case Restarting:
+			atomic.AddInt32(&upo.numRoutinesRestarting, -1)
 		case Errored:
-			panic(fmt.Errorf("cannot update the status of routine with index %d to state %s after it has already been set to %s state", routineIdx, newStatus.String(), previousStatus.String()))
+			panic(fmt.Errorf("cannot update the status of routine with index %d to state %s after it has already been set to %s state", state.routineIdx, newStatus.String(), previousStatus.String()))
 		case ContextDone:
-			panic(fmt.Errorf("cannot update the status of routine with index %d to state %s after it has already been set to %s state", routineIdx, newStatus.String(), previousStatus.String()))
+			panic(fmt.Errorf("cannot update the status of routine with index %d to state %s after it has already been set to %s state", state.routineIdx, newStatus.String(), previousStatus.String()))
 		case Finished:
-			panic(fmt.Errorf("cannot update the status of routine with index %d to state %s after it has already been set to %s state", routineIdx, newStatus.String(), previousStatus.String()))
+			panic(fmt.Errorf("cannot update the status of routine with index %d to state %s after it has already been set to %s state", state.routineIdx, newStatus.String(), previousStatus.String()))
+		case Retired:
+			panic(fmt.Errorf("cannot update the status of routine with index %d to state %s after it has already been set to %s state", state.routineIdx, newStatus.String(), previousStatus.String()))
 		default:
 			panic(fmt.Errorf("unknown routine status: %d", previousStatus))
 		}
 	}
-	upo.routineStatuses.Store(routineIdx, newStatus)
+	atomic.StoreInt32(&state.status, int32(newStatus))
+	atomic.StoreInt64(&state.statusSince, now)
 	// Now update the counter corresponding to the new state
 	switch newStatus {
 	case AwaitingInput:
@@ -102,6 +213,14 @@ func (upo *RoutineStatusTracker) updateRoutineStatus(routineIdx uint, newStatus
 		atomic.AddInt32(&upo.numRoutinesProcessingInput, 1)
 	case AwaitingOutput:
 		atomic.AddInt32(&upo.numRoutinesAwaitingOutput, 1)
+	case RateLimited:
+		atomic.AddInt32(&upo.numRoutinesRateLimited, 1)
+	case AwaitingLimiter:
+		atomic.AddInt32(&upo.numRoutinesAwaitingLimiter, 1)
+	case Paused:
+		atomic.AddInt32(&upo.numRoutinesPaused, 1)
+	case Restarting:
+		atomic.AddInt32(&upo.numRoutinesRestarting, 1)
 	case Errored:
 		atomic.AddInt32(&upo.numRoutinesErrored, 1)
 		remaining := atomic.AddInt32(&upo.numRoutinesRunning, -1)
@@ -123,12 +242,103 @@ func (upo *RoutineStatusTracker) updateRoutineStatus(routineIdx uint, newStatus
 		if remaining == 0 {
 			isLastRoutine = true
 		}
+	case Retired:
+		atomic.AddInt32(&upo.numRoutinesRetired, 1)
+		remaining := atomic.AddInt32(&upo.numRoutinesRunning, -1)
+		// If it's retired, it's done, so reduce the number of running routines
+		if remaining == 0 {
+			isLastRoutine = true
+		}
 	default:
 		panic(fmt.Errorf("unknown routine status: %d", newStatus))
 	}
+	if newStatus.isTerminal() {
+		upo.removeRoutineState(state)
+	}
 	return
 }
 
+// addRoutine counts a new routine as running, unless all routines have already
+// exited (in which case the executor is done and no routine can be added).
+func (rst *RoutineStatusTracker) addRoutine() bool {
+	for {
+		running := atomic.LoadInt32(&rst.numRoutinesRunning)
+		if running == 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&rst.numRoutinesRunning, running, running+1) {
+			return true
+		}
+	}
+}
+
+func (rst *RoutineStatusTracker) addFallback() {
+	atomic.AddUint64(&rst.numFallbacks, 1)
+}
+
+func (rst *RoutineStatusTracker) addIgnoredError() {
+	atomic.AddUint64(&rst.numIgnoredErrors, 1)
+}
+
+func (rst *RoutineStatusTracker) addRestart() {
+	atomic.AddUint64(&rst.numRestarts, 1)
+}
+
+// addProcessed counts an input that the processing function has finished in a
+// routine, and the error if it failed. Returns when it was counted.
+func (rst *RoutineStatusTracker) addProcessed(state *routineState, err error) (at time.Time) {
+	at = time.Now()
+	atomic.AddUint64(&rst.numProcessed, 1)
+	atomic.AddUint64(&state.numProcessed, 1)
+	if err != nil {
+		atomic.AddUint64(&rst.numErrors, 1)
+		state.lastError.Store(&routineError{
+			err: err,
+		})
+	}
+	atomic.StoreInt64(&rst.lastProgress, at.UnixNano())
+	return at
+}
+
+func (rst *RoutineStatusTracker) addInput(at time.Time) {
+	atomic.StoreInt64(&rst.lastInput, at.UnixNano())
+}
+
+func (rst *RoutineStatusTracker) addOutput(at time.Time) {
+	atomic.StoreInt64(&rst.lastOutput, at.UnixNano())
+}
+
+func (rst *RoutineStatusTracker) getLastOutput() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&rst.lastOutput))
+}
+
+// getLastActivity returns when an input was last taken, an output was last stored
+// or a heartbeat was last sent.
+func (rst *RoutineStatusTracker) getLastActivity() time.Time {
+	last := atomic.LoadInt64(&rst.lastInput)
+	if lastOutput := atomic.LoadInt64(&rst.lastOutput); lastOutput > last {
+		last = lastOutput
+	}
+	if lastHeartbeat := atomic.LoadInt64(&rst.lastHeartbeat); lastHeartbeat > last {
+		last = lastHeartbeat
+	}
+	return time.Unix(0, last)
+}
+
+// hasWork returns whether the executor has inputs waiting to be taken, or
+// routines that are processing or outputting an input.
+func (rst *RoutineStatusTracker) hasWork() bool {
+	backlog := rst.GetInputChanLength()
+	for _, depth := range rst.GetFairQueueDepths() {
+		backlog += depth
+	}
+	return backlog > 0 || rst.GetNumRoutinesProcessing() > 0 || rst.GetNumRoutinesAwaitingOutput() > 0
+}
+
+func (rst *RoutineStatusTracker) addLimiterWait(waited time.Duration) {
+	atomic.AddInt64(&rst.limiterWaitTime, int64(waited))
+}
+
 func (rst *RoutineStatusTracker) GetExecutorName() string {
 	return rst.executorName
 }
@@ -144,6 +354,18 @@ func (rst *RoutineStatusTracker) GetNumRoutinesProcessing() int32 {
 func (rst *RoutineStatusTracker) GetNumRoutinesAwaitingOutput() int32 {
 	return atomic.LoadInt32(&rst.numRoutinesAwaitingOutput)
 }
+func (rst *RoutineStatusTracker) GetNumRoutinesRateLimited() int32 {
+	return atomic.LoadInt32(&rst.numRoutinesRateLimited)
+}
+func (rst *RoutineStatusTracker) GetNumRoutinesAwaitingLimiter() int32 {
+	return atomic.LoadInt32(&rst.numRoutinesAwaitingLimiter)
+}
+func (rst *RoutineStatusTracker) GetNumRoutinesPaused() int32 {
+	return atomic.LoadInt32(&rst.numRoutinesPaused)
+}
+func (rst *RoutineStatusTracker) GetNumRoutinesRestarting() int32 {
+	return atomic.LoadInt32(&rst.numRoutinesRestarting)
+}
 func (rst *RoutineStatusTracker) GetNumRoutinesErrored() int32 {
 	return atomic.LoadInt32(&rst.numRoutinesErrored)
 }
@@ -153,10 +375,101 @@ func (rst *RoutineStatusTracker) GetNumRoutinesContextDone() int32 {
 func (rst *RoutineStatusTracker) GetNumRoutinesFinished() int32 {
 	return atomic.LoadInt32(&rst.numRoutinesFinished)
 }
+func (rst *RoutineStatusTracker) GetNumRoutinesRetired() int32 {
+	return atomic.LoadInt32(&rst.numRoutinesRetired)
+}
+func (rst *RoutineStatusTracker) GetNumFallbacks() uint64 {
+	return atomic.LoadUint64(&rst.numFallbacks)
+}
+func (rst *RoutineStatusTracker) GetNumIgnoredErrors() uint64 {
+	return atomic.LoadUint64(&rst.numIgnoredErrors)
+}
+func (rst *RoutineStatusTracker) GetNumRestarts() uint64 {
+	return atomic.LoadUint64(&rst.numRestarts)
+}
+func (rst *RoutineStatusTracker) GetNumProcessed() uint64 {
+	return atomic.LoadUint64(&rst.numProcessed)
+}
+
+// Returns the number of times the processing function returned an error or panicked,
+// including errors that were handled (e.g. by a fallback or a restart).
+func (rst *RoutineStatusTracker) GetNumErrors() uint64 {
+	return atomic.LoadUint64(&rst.numErrors)
+}
+
+// Returns when the processing function last finished an input or sent a heartbeat,
+// or when the executor started if it hasn't done either yet.
+func (rst *RoutineStatusTracker) GetLastProgress() time.Time {
+	last := atomic.LoadInt64(&rst.lastProgress)
+	if lastHeartbeat := atomic.LoadInt64(&rst.lastHeartbeat); lastHeartbeat > last {
+		last = lastHeartbeat
+	}
+	return time.Unix(0, last)
+}
+
+// Returns the last heartbeat that the routine with the given index sent from its
+// current call of the processing function, and false if it hasn't sent one.
+func (rst *RoutineStatusTracker) GetHeartbeat(routineIdx uint) (Heartbeat, bool) {
+	state, ok := rst.routineStates.Load(routineIdx)
+	if !ok {
+		return Heartbeat{}, false
+	}
+	return state.(*routineState).heartbeat.get()
+}
+
+// Returns the last heartbeats that the routines sent from their current calls of
+// the processing function, by routine index. Routines that haven't sent one (or
+// have exited) aren't included.
+func (rst *RoutineStatusTracker) GetHeartbeats() map[uint]Heartbeat {
+	heartbeats := map[uint]Heartbeat{}
+	rst.routineStates.Range(func(key, value any) bool {
+		state := value.(*routineState)
+		if state.getStatus().isTerminal() {
+			return true
+		}
+		if heartbeat, ok := state.heartbeat.get(); ok {
+			heartbeats[key.(uint)] = heartbeat
+		}
+		return true
+	})
+	return heartbeats
+}
+func (rst *RoutineStatusTracker) GetLimiterWaitTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&rst.limiterWaitTime))
+}
 func (rst *RoutineStatusTracker) GetInputChanLength() int {
 	return rst.getInputChanLength()
 }
 
+// Returns nil if the executor doesn't use fair queuing, or the number of inputs
+// currently queued for each key if it does.
+func (rst *RoutineStatusTracker) GetFairQueueDepths() map[string]int {
+	if rst.getFairQueueStats == nil {
+		return nil
+	}
+	depths, _ := rst.getFairQueueStats()
+	return depths
+}
+
+// Returns nil if the executor doesn't use fair queuing, or the number of inputs
+// of each key that have been taken from the fair queue if it does.
+func (rst *RoutineStatusTracker) GetFairQueueServed() map[string]uint64 {
+	if rst.getFairQueueStats == nil {
+		return nil
+	}
+	_, served := rst.getFairQueueStats()
+	return served
+}
+
+// Returns 0 if the executor doesn't have an adaptive limit, or the number of
+// processing function calls that can currently be in flight at once if it does.
+func (rst *RoutineStatusTracker) GetAdaptiveLimit() int {
+	if rst.getAdaptiveLimit == nil {
+		return 0
+	}
+	return rst.getAdaptiveLimit()
+}
+
 // Returns nil if there is no output channel, or a pointer to an int if there is
 func (rst *RoutineStatusTracker) GetOutputChanLength() *int {
 	return rst.getOutputChanLength()
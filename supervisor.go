@@ -0,0 +1,159 @@
+package concurrency
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+// SupervisorScope is what gets restarted when a routine of a supervised executor fails.
+type SupervisorScope int
+
+const (
+	// Only the routine that failed is restarted. The other routines keep running.
+	SupervisorScopeRoutine SupervisorScope = iota
+	// All routines of the executor are restarted together. The other routines restart
+	// once they've finished the input they're processing (or waiting for), and all of
+	// them wait for the backoff before taking another input.
+	SupervisorScopeExecutor
+)
+
+func (s SupervisorScope) String() string {
+	switch s {
+	case SupervisorScopeRoutine:
+		return "Routine"
+	case SupervisorScopeExecutor:
+		return "Executor"
+	default:
+		return "Unknown"
+	}
+}
+
+// Supervisor restarts routines of an executor that fail (by returning an error or
+// panicking), instead of failing the executor and the chain. The input that was being
+// processed when the routine failed is dropped. Restarts are counted in the
+// RoutineStatusTracker.
+type Supervisor struct {
+	// REQUIRED. The maximum number of restarts within the Window. Once a failure would
+	// exceed it, the failure isn't restarted and the executor fails as if there was no
+	// supervisor, which fails the chain. Supervision is disabled if this is 0.
+	MaxRestarts int
+	// OPTIONAL. The period over which restarts are counted. Defaults to the
+	// DefaultSupervisorWindow value.
+	Window time.Duration
+	// OPTIONAL. What gets restarted. Defaults to SupervisorScopeRoutine.
+	Scope SupervisorScope
+	// OPTIONAL. How long to wait before the first restart within the Window. Defaults
+	// to the DefaultSupervisorInitialBackoff value.
+	InitialBackoff time.Duration
+	// OPTIONAL. The maximum amount of time to wait before a restart. Defaults to the
+	// DefaultSupervisorMaxBackoff value.
+	MaxBackoff time.Duration
+	// OPTIONAL. How much longer to wait before each restart than before the previous
+	// one within the Window. Defaults to 2.
+	BackoffMultiplier float64
+	// OPTIONAL. A function to call before a routine is restarted. If it returns an
+	// error, the routine fails with that error instead of restarting.
+	Callback func(input *RoutineRestartCallbackInput) stackerr.Error
+}
+
+func (s Supervisor) enabled() bool {
+	return s.MaxRestarts > 0
+}
+
+// supervisor keeps track of the restarts of an executor's routines.
+type supervisor struct {
+	settings Supervisor
+
+	lock sync.Mutex
+	// The times of the restarts within the window
+	restarts []time.Time
+	// For SupervisorScopeExecutor, when the routines can start taking inputs again
+	resumeAt time.Time
+	// For SupervisorScopeExecutor, the number of times the executor has been restarted.
+	// Routines that have seen an older generation have to restart.
+	generation uint64
+}
+
+func newSupervisor(settings Supervisor) *supervisor {
+	if !settings.enabled() {
+		return nil
+	}
+	settings.Window = zeroDefault(settings.Window, DefaultSupervisorWindow)
+	settings.InitialBackoff = zeroDefault(settings.InitialBackoff, DefaultSupervisorInitialBackoff)
+	settings.MaxBackoff = zeroDefault(settings.MaxBackoff, DefaultSupervisorMaxBackoff)
+	if settings.BackoffMultiplier < 1 {
+		settings.BackoffMultiplier = 2
+	}
+	return &supervisor{
+		settings: settings,
+	}
+}
+
+// restart records a failure. Returns the number of restarts within the window
+// (including this one) and how long to wait before restarting, or false if the
+// maximum number of restarts has been reached, in which case the failure has to
+// be escalated.
+func (s *supervisor) restart() (restarts int, backoff time.Duration, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	// Forget the restarts that are outside of the window
+	kept := s.restarts[:0]
+	for _, restart := range s.restarts {
+		if now.Sub(restart) < s.settings.Window {
+			kept = append(kept, restart)
+		}
+	}
+	s.restarts = kept
+	if len(s.restarts) >= s.settings.MaxRestarts {
+		return len(s.restarts), 0, false
+	}
+	s.restarts = append(s.restarts, now)
+	restarts = len(s.restarts)
+
+	backoff = time.Duration(math.Min(
+		float64(s.settings.InitialBackoff)*math.Pow(s.settings.BackoffMultiplier, float64(restarts-1)),
+		float64(s.settings.MaxBackoff),
+	))
+	if s.settings.Scope == SupervisorScopeExecutor {
+		if resumeAt := now.Add(backoff); resumeAt.After(s.resumeAt) {
+			s.resumeAt = resumeAt
+		}
+		atomic.AddUint64(&s.generation, 1)
+	}
+	return restarts, backoff, true
+}
+
+// getGeneration returns the number of times the executor has been restarted.
+func (s *supervisor) getGeneration() uint64 {
+	if s == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&s.generation)
+}
+
+// wait waits until the routines can start taking inputs again after a restart.
+// Returns false if the context is done first.
+func (s *supervisor) wait(ctx context.Context, backoff time.Duration) bool {
+	if s.settings.Scope == SupervisorScopeExecutor {
+		s.lock.Lock()
+		backoff = time.Until(s.resumeAt)
+		s.lock.Unlock()
+	}
+	if backoff <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,134 @@
+package concurrency
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// The cause of the cancellation of an executor that was still processing the
+	// outputs of a failed upstream executor when its UpstreamErrorDrainTimeout ended.
+	ErrUpstreamErrorDrainTimeout = errors.New("timed out processing the outputs of a failed upstream executor")
+	// The cause of the cancellation of an executor that had processed its
+	// UpstreamErrorDrainMaxItems outputs of a failed upstream executor.
+	ErrUpstreamErrorDrainMaxItems = errors.New("reached the maximum number of outputs of a failed upstream executor to process")
+)
+
+// UpstreamErrorDrain is the outcome of processing the outputs of a failed upstream
+// executor, for executors with ProcessUpstreamOutputsAfterUpstreamError.
+type UpstreamErrorDrain struct {
+	// The number of inputs that were taken after the upstream executor failed
+	Drained uint64
+	// The number of inputs that were left unprocessed because the drain was cut short
+	Abandoned uint64
+	// How long the executor kept processing after the upstream executor failed
+	Duration time.Duration
+	// Why the drain was cut short (ErrUpstreamErrorDrainTimeout or
+	// ErrUpstreamErrorDrainMaxItems), or nil if everything was processed.
+	Err error
+}
+
+// upstreamErrorDrain tracks an executor that keeps processing the outputs of a
+// failed upstream executor, and cancels it once its limits are reached.
+type upstreamErrorDrain struct {
+	timeout  time.Duration
+	maxItems uint64
+	// Cancels the executor's internal context
+	cancel func(cause error)
+
+	started   atomic.Bool
+	startTime time.Time
+	// The number of inputs taken since the upstream executor failed
+	drained uint64
+	// The number of inputs that were taken but not processed, because
+	// the maximum had already been reached
+	rejected uint64
+
+	cutShortOnce sync.Once
+	cutShortErr  error
+}
+
+func newUpstreamErrorDrain(timeout time.Duration, maxItems int, cancel func(cause error)) *upstreamErrorDrain {
+	if maxItems < 0 {
+		maxItems = 0
+	}
+	return &upstreamErrorDrain{
+		timeout:  timeout,
+		maxItems: uint64(maxItems),
+		cancel:   cancel,
+	}
+}
+
+// watch waits for the upstream executor to fail, and then starts counting the
+// inputs and the time. It returns once the executor has finished.
+func (ued *upstreamErrorDrain) watch(upstreamErrored <-chan struct{}, finished <-chan struct{}) {
+	select {
+	case <-finished:
+		return
+	case <-upstreamErrored:
+	}
+	ued.startTime = time.Now()
+	ued.started.Store(true)
+	if ued.timeout <= 0 {
+		return
+	}
+	timer := time.NewTimer(ued.timeout)
+	defer timer.Stop()
+	select {
+	case <-finished:
+	case <-timer.C:
+		ued.cutShort(ErrUpstreamErrorDrainTimeout)
+	}
+}
+
+func (ued *upstreamErrorDrain) cutShort(cause error) {
+	ued.cutShortOnce.Do(func() {
+		ued.cutShortErr = cause
+		ued.cancel(cause)
+	})
+}
+
+// take counts an input that was taken from the input channel. Returns false if
+// the maximum number of inputs to process after the upstream executor failed
+// has already been reached, in which case the executor has been cancelled.
+func (ued *upstreamErrorDrain) take() bool {
+	if !ued.started.Load() {
+		return true
+	}
+	for {
+		drained := atomic.LoadUint64(&ued.drained)
+		if ued.maxItems > 0 && drained >= ued.maxItems {
+			atomic.AddUint64(&ued.rejected, 1)
+			ued.cutShort(ErrUpstreamErrorDrainMaxItems)
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&ued.drained, drained, drained+1) {
+			return true
+		}
+	}
+}
+
+// result returns the outcome of the drain, or nil if the upstream executor didn't
+// fail. It must only be called once all routines of the executor have exited, with
+// the number of inputs left in the input channel.
+func (ued *upstreamErrorDrain) result(inputChanLength int) *UpstreamErrorDrain {
+	if !ued.started.Load() {
+		return nil
+	}
+	result := &UpstreamErrorDrain{
+		Drained:   atomic.LoadUint64(&ued.drained),
+		Abandoned: atomic.LoadUint64(&ued.rejected),
+		Duration:  time.Since(ued.startTime),
+	}
+	// Wait for a cut short that's in progress (and stop any from starting),
+	// so that the error can be read.
+	ued.cutShortOnce.Do(func() {})
+	// Only a drain that was cut short leaves inputs behind
+	if ued.cutShortErr != nil {
+		result.Err = ued.cutShortErr
+		result.Abandoned += uint64(inputChanLength)
+	}
+	return result
+}
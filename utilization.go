@@ -0,0 +1,117 @@
+package concurrency
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The number of routine statuses, for arrays indexed by status
+const numRoutineStatuses = int(Restarting) + 1
+
+// Utilization is how the time of routines has been spent. The ratios are fractions
+// of the RoutineTime and add up to 1 (unless no time has been spent yet).
+type Utilization struct {
+	// The total amount of time that routines have been running, summed over routines
+	RoutineTime time.Duration
+	// The fraction of the time spent waiting for an input
+	AwaitingInput float64
+	// The fraction of the time spent processing an input
+	Processing float64
+	// The fraction of the time spent waiting to store an output
+	AwaitingOutput float64
+	// The fraction of the time spent waiting for the rate limit
+	RateLimited float64
+	// The fraction of the time spent waiting for the shared or the adaptive limiter
+	AwaitingLimiter float64
+	// The fraction of the time spent paused
+	Paused float64
+	// The fraction of the time spent waiting to restart after a failure
+	Restarting float64
+}
+
+// newUtilization calculates the utilization from the time spent in each status.
+func newUtilization(timeInStatus []time.Duration) *Utilization {
+	u := &Utilization{}
+	for _, t := range timeInStatus {
+		u.RoutineTime += t
+	}
+	if u.RoutineTime <= 0 {
+		return u
+	}
+	ratio := func(status routineStatus) float64 {
+		return float64(timeInStatus[status]) / float64(u.RoutineTime)
+	}
+	u.AwaitingInput = ratio(AwaitingInput)
+	u.Processing = ratio(Processing)
+	u.AwaitingOutput = ratio(AwaitingOutput)
+	u.RateLimited = ratio(RateLimited)
+	u.AwaitingLimiter = ratio(AwaitingLimiter)
+	u.Paused = ratio(Paused)
+	u.Restarting = ratio(Restarting)
+	return u
+}
+
+// addTimeInStatus adds the time a routine spent in a status that it just left.
+func (rst *RoutineStatusTracker) addTimeInStatus(state *routineState, status routineStatus, elapsed time.Duration) {
+	atomic.AddInt64(&state.timeInStatus[status], int64(elapsed))
+}
+
+// currentTimeInStatus returns how long a routine has been in its current status,
+// unless it has exited.
+func (rs *routineState) currentTimeInStatus(now time.Time) (status routineStatus, elapsed time.Duration, ok bool) {
+	status = rs.getStatus()
+	if status == noStatus || status.isTerminal() {
+		return status, 0, false
+	}
+	return status, now.Sub(time.Unix(0, atomic.LoadInt64(&rs.statusSince))), true
+}
+
+// getTimeInStatus returns the time the routine has spent in each status, including
+// the time in its current status.
+func (rs *routineState) getTimeInStatus(now time.Time) []time.Duration {
+	times := make([]time.Duration, numRoutineStatuses)
+	for status := range times {
+		times[status] = time.Duration(atomic.LoadInt64(&rs.timeInStatus[status]))
+	}
+	if status, elapsed, ok := rs.currentTimeInStatus(now); ok {
+		times[status] += elapsed
+	}
+	return times
+}
+
+// getTimeInStatus returns the time the executor's routines have spent in each status,
+// summed over routines, including the time in the statuses they're currently in.
+func (rst *RoutineStatusTracker) getTimeInStatus() []time.Duration {
+	now := time.Now()
+	rst.exitedLock.RLock()
+	defer rst.exitedLock.RUnlock()
+	times := make([]time.Duration, numRoutineStatuses)
+	for status := range times {
+		times[status] = time.Duration(rst.timeInStatus[status])
+	}
+	rst.routineStates.Range(func(key, value any) bool {
+		state := value.(*routineState)
+		for status := range times {
+			times[status] += time.Duration(atomic.LoadInt64(&state.timeInStatus[status]))
+		}
+		if status, elapsed, ok := state.currentTimeInStatus(now); ok {
+			times[status] += elapsed
+		}
+		return true
+	})
+	return times
+}
+
+// Returns the total amount of time the executor's routines have spent in the given
+// status, summed over routines, including the time of routines that are in it now.
+func (rst *RoutineStatusTracker) GetTimeInStatus(status routineStatus) time.Duration {
+	if status < 0 || int(status) >= numRoutineStatuses {
+		return 0
+	}
+	return rst.getTimeInStatus()[status]
+}
+
+// Returns how the time of the executor's routines has been spent so far.
+func (rst *RoutineStatusTracker) GetUtilization() *Utilization {
+	return newUtilization(rst.getTimeInStatus())
+}
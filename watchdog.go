@@ -0,0 +1,188 @@
+package concurrency
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Invicton-Labs/go-stackerr"
+)
+
+const (
+	// The profiler label with the name of the executor a routine belongs to
+	watchdogExecutorLabel = "concurrency_executor"
+	// The profiler label with an ID that's unique to the executor, since names don't have to be
+	watchdogExecutorIDLabel = "concurrency_executor_id"
+	// The profiler label with the index of the routine
+	watchdogRoutineLabel = "concurrency_routine"
+)
+
+// The last ID that was given to an executor with a watchdog
+var lastWatchdogExecutorID uint64
+
+// Watchdog watches an executor for stalls, where it has work but hasn't taken an
+// input or stored an output for a while, and reports what its routines are doing.
+type Watchdog struct {
+	// REQUIRED. How long the executor can go without taking an input or storing an
+	// output, while it has inputs waiting or being processed, before it's stalled. The
+	// watchdog is disabled if this is 0.
+	StallTimeout time.Duration
+	// OPTIONAL. How often to check for a stall. Defaults to the DefaultWatchdogInterval
+	// value.
+	Interval time.Duration
+	// OPTIONAL. A function to call with the report when the executor stalls. It's only
+	// called once per stall, until the executor makes progress again. If it returns an
+	// error, the executor fails with that error. Either this or FailChain is required.
+	Callback func(input *StallCallbackInput) stackerr.Error
+	// OPTIONAL. Whether to fail the executor (and with it the chain) with a StallError
+	// when it stalls, after calling the Callback. Either this or Callback is required.
+	FailChain bool
+}
+
+func (w Watchdog) enabled() bool {
+	return w.StallTimeout > 0
+}
+
+// StalledRoutine is what a routine of a stalled executor was doing.
+type StalledRoutine struct {
+	// The index of the routine
+	RoutineIndex uint
+	// The executor input index of the input the routine was working on (or waiting for)
+	ExecutorInputIndex uint64
+	// The status of the routine
+	Status routineStatus
+}
+
+// StallReport describes an executor that has stalled.
+type StallReport struct {
+	// The name of the executor
+	ExecutorName string
+	// How long it's been since the executor took an input or stored an output
+	TimeSinceProgress time.Duration
+	// The routines of the executor that were still running, in order of their index
+	Routines []StalledRoutine
+	// The stack traces of the goroutines of the executor's routines, in the format of
+	// the goroutine profile (with debug=1), where each stack is annotated with the
+	// executor and the routine index it belongs to. Goroutines that were started by the
+	// processing function are included too.
+	Stacks string
+}
+
+// StallError is the cause of the failure of an executor that stalled, for
+// watchdogs with FailChain.
+type StallError struct {
+	Report *StallReport
+}
+
+func (se *StallError) Error() string {
+	return fmt.Sprintf("executor %s made no progress for %s", se.Report.ExecutorName, se.Report.TimeSinceProgress)
+}
+
+// watchdogLabels returns the profiler labels for a routine of an executor.
+func watchdogLabels(executorName string, executorID uint64, routineIdx uint) pprof.LabelSet {
+	return pprof.Labels(
+		watchdogExecutorLabel, executorName,
+		watchdogExecutorIDLabel, strconv.FormatUint(executorID, 10),
+		watchdogRoutineLabel, strconv.FormatUint(uint64(routineIdx), 10),
+	)
+}
+
+// executorStacks returns the stacks of the goroutines that have the profiler label
+// with the ID of the executor.
+func executorStacks(executorID uint64) string {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return ""
+	}
+	// The profile has a record for each distinct stack (and set of labels),
+	// separated by blank lines, and the labels are listed in each record.
+	label := fmt.Sprintf("%q:%q", watchdogExecutorIDLabel, strconv.FormatUint(executorID, 10))
+	var stacks []string
+	for _, record := range strings.Split(buf.String(), "\n\n") {
+		for _, line := range strings.Split(record, "\n") {
+			if strings.HasPrefix(line, "# labels: ") && strings.Contains(line, label) {
+				stacks = append(stacks, strings.TrimSpace(record))
+				break
+			}
+		}
+	}
+	return strings.Join(stacks, "\n\n")
+}
+
+// stallReport creates a report of what the routines of a stalled executor are doing.
+func (rst *RoutineStatusTracker) stallReport(timeSinceProgress time.Duration, executorID uint64) *StallReport {
+	report := &StallReport{
+		ExecutorName:      rst.GetExecutorName(),
+		TimeSinceProgress: timeSinceProgress,
+		Stacks:            executorStacks(executorID),
+	}
+	for _, routine := range rst.Routines() {
+		if routine.Status.isTerminal() {
+			continue
+		}
+		report.Routines = append(report.Routines, StalledRoutine{
+			RoutineIndex:       routine.RoutineIndex,
+			ExecutorInputIndex: routine.ExecutorInputIndex,
+			Status:             routine.Status,
+		})
+	}
+	return report
+}
+
+// runWatchdog checks the executor for stalls at every interval, until the executor
+// has finished.
+func runWatchdog(
+	ctx context.Context,
+	finished <-chan struct{},
+	settings Watchdog,
+	executorID uint64,
+	tracker *RoutineStatusTracker,
+	baseExecutorCallbackInput *BaseExecutorCallbackInput,
+	fail func(err error),
+) {
+	ticker := time.NewTicker(zeroDefault(settings.Interval, DefaultWatchdogInterval))
+	defer ticker.Stop()
+
+	// Whether the current stall has already been reported
+	reported := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-finished:
+			return
+		case <-ticker.C:
+		}
+
+		timeSinceProgress := time.Since(tracker.getLastActivity())
+		if !tracker.hasWork() || timeSinceProgress <= settings.StallTimeout {
+			reported = false
+			continue
+		}
+		if reported {
+			continue
+		}
+		reported = true
+
+		report := tracker.stallReport(timeSinceProgress, executorID)
+		if settings.Callback != nil {
+			if err := settings.Callback(&StallCallbackInput{
+				BaseExecutorCallbackInput: baseExecutorCallbackInput,
+				Report:                    report,
+			}); err != nil {
+				fail(err)
+				return
+			}
+		}
+		if settings.FailChain {
+			fail(&StallError{
+				Report: report,
+			})
+			return
+		}
+	}
+}